@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -115,6 +116,37 @@ type ebmlTag struct {
 	Length   uint64
 }
 
+func ebmlSize(length uint64) []byte {
+	n := uint(1)
+	for ; n < 8 && length >= 1<<(7*n)-1; n++ {
+	}
+	xs := make([]byte, n)
+	for i := range xs {
+		xs[i] = byte(length >> (8 * (n - uint(i) - 1)))
+	}
+	xs[0] |= 1 << (8 - n)
+	return xs
+}
+
+func ebmlAppendTag(buf []byte, id uint, data []byte) []byte {
+	n := uint(1)
+	for ; n < 4 && id>>(8*n) != 0; n++ {
+	}
+	for ; n != 0; n-- {
+		buf = append(buf, byte(id>>(8*(n-1))))
+	}
+	buf = append(buf, ebmlSize(uint64(len(data)))...)
+	return append(buf, data...)
+}
+
+func ebmlAppendUint(buf []byte, id uint, x uint64) []byte {
+	data := []byte{byte(x)}
+	for x >>= 8; x != 0; x >>= 8 {
+		data = append([]byte{byte(x)}, data...)
+	}
+	return ebmlAppendTag(buf, id, data)
+}
+
 func ebmlParseTagIncomplete(data []byte) ebmlTag {
 	if id, off := ebmlTagID(data); off != 0 {
 		if length, off2 := ebmlUint(data[off:]); off2 != 0 {
@@ -139,6 +171,105 @@ func (t ebmlTag) Skip(data []byte) []byte {
 	return data[uint64(t.Consumed)+t.Length:]
 }
 
+// Extract the track number, the timecode relative to the cluster, and the keyframe
+// flag from a SimpleBlock or a BlockGroup. `buf` must contain the whole tag.
+func ebmlParseBlock(tag ebmlTag, buf []byte) (uint64, uint64, bool, error) {
+	key := false
+	block := tag.Contents(buf)
+
+	if tag.ID == ebmlTagBlockGroup {
+		key, block = true, nil
+
+		for buf2 := tag.Contents(buf); len(buf2) != 0; {
+			tag2 := ebmlParseTag(buf2)
+
+			switch tag2.ID {
+			case 0:
+				return 0, 0, false, errors.New("malformed EBML")
+
+			case ebmlTagBlock:
+				block = tag2.Contents(buf2)
+
+			case ebmlTagReferenceBlock:
+				// Keyframes, by definition, have no reference frame.
+				key = fixedUint(tag2.Contents(buf2)) == 0
+			}
+
+			buf2 = tag2.Skip(buf2)
+		}
+
+		if block == nil {
+			return 0, 0, false, errors.New("a BlockGroup contains no Blocks")
+		}
+	}
+
+	track, consumed := ebmlUint(block)
+	if consumed == 0 || track >= 32 || len(block) < consumed+3 {
+		return 0, 0, false, errors.New("invalid track")
+	}
+	// This bit is always 0 in a Block, but 1 in a keyframe SimpleBlock.
+	key = key || block[consumed+2]&0x80 != 0
+	// Block timecodes are relative to cluster ones.
+	timecode := uint64(block[consumed+0])<<8 | uint64(block[consumed+1])
+	return track, timecode, key, nil
+}
+
+// Collect the values of SimpleTags from a Tag that applies to the whole segment
+// (tags targeted at specific tracks, e.g. per-track encoder info, are ignored.)
+func ebmlParseSimpleTags(buf []byte, tags map[string]string) error {
+	local := make(map[string]string)
+
+	for len(buf) != 0 {
+		tag := ebmlParseTag(buf)
+
+		switch tag.ID {
+		case 0:
+			return errors.New("malformed EBML")
+
+		case ebmlTagTargets:
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+				if tag2.ID == 0 {
+					return errors.New("malformed EBML")
+				}
+				if tag2.ID == ebmlTagTagTrackUID && fixedUint(tag2.Contents(buf2)) != 0 {
+					return nil
+				}
+				buf2 = tag2.Skip(buf2)
+			}
+
+		case ebmlTagSimpleTag:
+			name, value := "", ""
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+
+				switch tag2.ID {
+				case 0:
+					return errors.New("malformed EBML")
+
+				case ebmlTagTagName:
+					name = string(tag2.Contents(buf2))
+
+				case ebmlTagTagString:
+					value = string(tag2.Contents(buf2))
+				}
+
+				buf2 = tag2.Skip(buf2)
+			}
+			if name != "" && value != "" {
+				local[name] = value
+			}
+		}
+
+		buf = tag.Skip(buf)
+	}
+
+	for k, v := range local {
+		tags[k] = v
+	}
+	return nil
+}
+
 type frame struct {
 	buf   []byte // Either a Block(Group) or a Cluster.
 	track uint64 // 64 for a Cluster (track masks are 32-bit, so streams with a real 64-th track are rejected)
@@ -217,22 +348,54 @@ func (cb *viewer) WriteFrame(cluster []byte, forceCluster bool, packed frame) {
 type BroadcastSet struct {
 	mutex   sync.Mutex
 	streams map[string]*Broadcast
+	egress  int64 // Total bytes sent to viewers; see `CountEgress`.
 	// How long to keep a stream alive after a call to `Close`.
 	Timeout time.Duration
 	// Called right after a stream is destroyed. (`Timeout` seconds after a `Close`.)
 	OnStreamClose     func(id string)
 	OnStreamTrackInfo func(id string, info *StreamTrackInfo)
+	OnStreamTags      func(id string, tags map[string]string)
+	// Called once for each new stream, before any data is written to it.
+	OnStreamOpen func(id string, cast *Broadcast)
+	// How long the broadcaster may stay silent before the slate is shown.
+	SlateDelay time.Duration
+	// Streams that have not been destroyed yet; see `Shutdown`.
+	alive    sync.WaitGroup
+	shutdown bool
+}
+
+// Per-stream settings, mostly chosen by the owner.
+type BroadcastOptions struct {
+	// A clip to loop while the broadcaster is silent. May be nil.
+	Slate *Slate
+	// Release blocks no faster than real time, blocking the writer if necessary.
+	Paced bool
+	// Add a WebVTT track to which captions can be posted with `Caption`.
+	Captions bool
+	// Pass Tags through to viewers in addition to reporting them via `OnStreamTags`.
+	ForwardTags bool
 }
 
 type Broadcast struct {
 	StreamTrackInfo
+	BroadcastOptions
+	Session int64 // The database ID of this particular broadcast, if any.
 	closing time.Duration
+	destroy chan struct{} // Closed to skip the rest of the timeout.
 	Closed  bool
 	dirty   bool // (Has unseen data in `StreamTrackInfo`.)
 	buffer  []byte
 	header  []byte // The EBML (DocType) tag.
 	tracks  []byte // The beginning of the Segment (Tracks + Info).
-	frames  framebuffer
+	// offset of the Tracks tag in `tracks`, and the number of the caption track in it.
+	tracksAt  int
+	textTrack uint64
+	frames    framebuffer
+	codecs    [32]string // CodecID of each track.
+	// Captions waiting for their start time; see `Caption`.
+	captionTimers map[*time.Timer]struct{}
+	// Bit vector of tracks that contain video.
+	videoTracks uint32
 	// outbound clusters must have monotonically increasing timecodes even if the inbound
 	// stream restarts from the beginning.
 	firstBlockInSegment bool
@@ -246,9 +409,24 @@ type Broadcast struct {
 	rateUnit float64
 	RateMean float64
 	RateVar  float64
-
+	// Segment-wide tags (TITLE, ARTIST, etc.) from the last Tags element; see `Tags`.
+	// With `ForwardTags`, the element itself is sent to viewers before the next cluster.
+	tags        map[string]string
+	tagsDirty   bool
+	pendingTags []byte
+	// while the slate is active, inbound blocks are dropped until the next keyframe.
+	slateActive bool
+	lastWrite   time.Time
+	// when paced, a block with timecode `paceBase + x` is sent at `paceStart + x ms`.
+	paceStart time.Time
+	paceBase  uint64
+
+	wlock   sync.Mutex // Serializes `Write` with the slate loop.
 	vlock   sync.Mutex
 	viewers map[chan<- []byte]*viewer
+
+	// Viewers that are people rather than recorders or relays; see `Watch`.
+	watchers int32
 }
 
 func (ctx *BroadcastSet) Readable(id string) (*Broadcast, bool) {
@@ -261,12 +439,45 @@ func (ctx *BroadcastSet) Readable(id string) (*Broadcast, bool) {
 	return cast, ok
 }
 
+// The number of streams being broadcast (including those within the timeout)
+// and the number of viewers connected to them.
+func (ctx *BroadcastSet) Load() (ingests int, viewers int) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	for _, cast := range ctx.streams {
+		viewers += cast.Viewers()
+	}
+	return len(ctx.streams), viewers
+}
+
+// A snapshot of all streams currently in this set.
+func (ctx *BroadcastSet) Streams() map[string]*Broadcast {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	streams := make(map[string]*Broadcast, len(ctx.streams))
+	for id, cast := range ctx.streams {
+		streams[id] = cast
+	}
+	return streams
+}
+
+func (ctx *BroadcastSet) CountEgress(n int) {
+	atomic.AddInt64(&ctx.egress, int64(n))
+}
+
+func (ctx *BroadcastSet) Egress() int64 {
+	return atomic.LoadInt64(&ctx.egress)
+}
+
 func (ctx *BroadcastSet) Writable(id string) (*Broadcast, bool) {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
 	if ctx.streams == nil {
 		ctx.streams = make(map[string]*Broadcast)
 	}
+	if ctx.shutdown {
+		return nil, false
+	}
 	if cast, ok := ctx.streams[id]; ok {
 		if cast.closing == -1 {
 			return nil, false
@@ -276,17 +487,39 @@ func (ctx *BroadcastSet) Writable(id string) (*Broadcast, bool) {
 	}
 	cast := Broadcast{
 		closing:             -1,
+		destroy:             make(chan struct{}),
 		frames:              framebuffer{make([]frame, 0, 120), 0, nil},
 		viewers:             make(map[chan<- []byte]*viewer),
 		sentClusterTimecode: 0xFFFFFFFFFFFFFFFF,
 	}
+	if ctx.OnStreamOpen != nil {
+		ctx.OnStreamOpen(id, &cast)
+	}
 	ctx.streams[id] = &cast
+	ctx.alive.Add(1)
 	go func() {
+		defer ctx.alive.Done()
 		ticker := time.NewTicker(time.Second)
-		for range ticker.C {
-			if cast.dirty {
-				cast.dirty = false
-				ctx.OnStreamTrackInfo(id, &cast.StreamTrackInfo)
+	loop:
+		for {
+			select {
+			case <-ticker.C:
+			case <-cast.destroy:
+				break loop
+			}
+			cast.wlock.Lock()
+			info, infoDirty := cast.StreamTrackInfo, cast.dirty
+			tags, tagsDirty := cast.tags, cast.tagsDirty
+			cast.dirty, cast.tagsDirty = false, false
+			cast.wlock.Unlock()
+			if infoDirty && ctx.OnStreamTrackInfo != nil {
+				ctx.OnStreamTrackInfo(id, &info)
+			}
+			if tagsDirty && ctx.OnStreamTags != nil {
+				ctx.OnStreamTags(id, tags)
+			}
+			if cast.Slate != nil {
+				cast.startSlate(ctx.SlateDelay)
 			}
 			if cast.closing >= 0 {
 				if cast.closing += time.Second; cast.closing > ctx.Timeout {
@@ -305,7 +538,13 @@ func (ctx *BroadcastSet) Writable(id string) (*Broadcast, bool) {
 		ctx.mutex.Lock()
 		delete(ctx.streams, id)
 		ctx.mutex.Unlock()
+		cast.wlock.Lock()
 		cast.Closed = true
+		for timer := range cast.captionTimers {
+			timer.Stop()
+		}
+		cast.captionTimers = nil
+		cast.wlock.Unlock()
 		cast.vlock.Lock()
 		for _, cb := range cast.viewers {
 			cb.write([]byte{})
@@ -318,6 +557,20 @@ func (ctx *BroadcastSet) Writable(id string) (*Broadcast, bool) {
 	return &cast, true
 }
 
+// Destroy all streams right away, as if their timeouts have expired, and wait until
+// `OnStreamClose` has returned for each one. No new streams can be created after this.
+func (ctx *BroadcastSet) Shutdown() {
+	ctx.mutex.Lock()
+	if !ctx.shutdown {
+		ctx.shutdown = true
+		for _, cast := range ctx.streams {
+			close(cast.destroy)
+		}
+	}
+	ctx.mutex.Unlock()
+	ctx.alive.Wait()
+}
+
 func (cast *Broadcast) Close() error {
 	cast.closing = 0
 	return nil
@@ -340,6 +593,40 @@ func (cast *Broadcast) Connect(ch chan<- []byte, skipHeaders bool) {
 	cast.vlock.Unlock()
 }
 
+// Same as `Connect`, but instead of skipping data when `ch` is full, wait until it
+// is not, or until `stop` is closed. Everyone else waits too, so this is only for
+// recorders, which must not skip anything. Close `stop` before `Disconnect`.
+func (cast *Broadcast) ConnectBlocking(ch chan<- []byte, stop <-chan struct{}) {
+	write := func(data []byte) bool {
+		select {
+		case ch <- data:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	cast.vlock.Lock()
+	cast.viewers[ch] = &viewer{write: write}
+	cast.vlock.Unlock()
+}
+
+// Count someone as watching the stream until the returned function is called.
+func (cast *Broadcast) Watch() (unwatch func()) {
+	atomic.AddInt32(&cast.watchers, 1)
+	return func() { atomic.AddInt32(&cast.watchers, -1) }
+}
+
+func (cast *Broadcast) Audience() int {
+	return int(atomic.LoadInt32(&cast.watchers))
+}
+
+func (cast *Broadcast) Viewers() int {
+	cast.vlock.Lock()
+	defer cast.vlock.Unlock()
+	return len(cast.viewers)
+}
+
 func (cast *Broadcast) Disconnect(ch chan<- []byte) {
 	cast.vlock.Lock()
 	delete(cast.viewers, ch)
@@ -350,7 +637,199 @@ func (cast *Broadcast) Reset() {
 	cast.buffer = nil
 }
 
+func (cast *Broadcast) send(ctc uint64, packed frame) {
+	cluster := []byte{
+		// indeterminate length cluster
+		ebmlTagCluster >> 24 & 0xFF, ebmlTagCluster >> 16 & 0xFF, ebmlTagCluster >> 8 & 0xFF, ebmlTagCluster & 0xFF, 0xFF,
+		// first child: 8-byte timecode
+		ebmlTagTimecode, 0x88,
+		byte(ctc >> 56), byte(ctc >> 48), byte(ctc >> 40), byte(ctc >> 32),
+		byte(ctc >> 24), byte(ctc >> 16), byte(ctc >> 8), byte(ctc),
+	}
+
+	forceCluster := ctc != cast.sentClusterTimecode
+	tags := cast.pendingTags
+	if !forceCluster {
+		tags = nil // (top-level elements can only go between clusters)
+	}
+	cast.vlock.Lock()
+	for _, cb := range cast.viewers {
+		if !cb.skipHeaders {
+			if !cb.write(cast.header) || !cb.write(cast.tracks) {
+				continue // FIXME: if second write failed, the stream will not be a valid mkv
+			}
+			cb.skipHeaders = true
+			cast.frames.Read(cb.WriteFrame)
+		}
+		if tags != nil {
+			cb.write(tags)
+		}
+		cb.WriteFrame(cluster, forceCluster, packed)
+	}
+	cast.vlock.Unlock()
+	if tags != nil {
+		cast.pendingTags = nil
+	}
+	if forceCluster {
+		cast.frames.PushCluster(cluster)
+	}
+	cast.frames.PushFrame(packed)
+	cast.sentClusterTimecode = ctc
+}
+
+// Make every viewer wait for the next keyframe on each track. Used when switching
+// between two unrelated sources, as frames of one cannot reference frames of the other.
+func (cast *Broadcast) resync() {
+	cast.vlock.Lock()
+	for _, cb := range cast.viewers {
+		cb.seenKeyframes = 0
+	}
+	cast.vlock.Unlock()
+	cast.frames = framebuffer{cast.frames.data[:0], 0, nil}
+}
+
+// The segment-wide tags last sent by the broadcaster. The map must not be modified.
+func (cast *Broadcast) Tags() map[string]string {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	return cast.tags
+}
+
+// The timecode of the last block sent to viewers.
+func (cast *Broadcast) Timecode() uint64 {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	return cast.sentTimecode
+}
+
+// Insert a WebVTT TrackEntry into the Tracks tag, which must be complete.
+func (cast *Broadcast) addTextTrack() {
+	track := uint64(1)
+	for ; track < 32 && cast.codecs[track] != ""; track++ {
+	}
+	if track == 32 || cast.tracksAt == 0 {
+		return
+	}
+	entry := ebmlAppendUint(nil, ebmlTagTrackNumber, track)
+	entry = ebmlAppendUint(entry, ebmlTagTrackUID, track)
+	entry = ebmlAppendUint(entry, ebmlTagTrackType, 0x11 /* subtitle */)
+	entry = ebmlAppendUint(entry, ebmlTagFlagLacing, 0)
+	entry = ebmlAppendTag(entry, ebmlTagCodecID, []byte("S_TEXT/WEBVTT"))
+	entry = ebmlAppendTag(entry, ebmlTagName, []byte("Captions"))
+	entry = ebmlAppendTag(nil, ebmlTagTrackEntry, entry)
+
+	tag := ebmlParseTagIncomplete(cast.tracks[cast.tracksAt:])
+	start := cast.tracksAt + tag.Consumed
+	end := start + int(tag.Length)
+	if tag.ID != ebmlTagTracks || end > len(cast.tracks) {
+		return
+	}
+	tracks := append([]byte{}, cast.tracks[:cast.tracksAt]...)
+	tracks = ebmlAppendTag(tracks, ebmlTagTracks, append(append([]byte{}, cast.tracks[start:end]...), entry...))
+	cast.tracks = append(tracks, cast.tracks[end:]...)
+	cast.codecs[track] = "S_TEXT/WEBVTT"
+	cast.textTrack = track
+}
+
+// Show a line of text on the caption track after `delay` for `duration`.
+func (cast *Broadcast) Caption(text string, delay time.Duration, duration time.Duration) error {
+	if !cast.Captions {
+		return ErrNoCaptions
+	}
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	if cast.Closed {
+		return nil
+	}
+	if cast.captionTimers == nil {
+		cast.captionTimers = make(map[*time.Timer]struct{})
+	}
+	// Pending captions are dropped once the stream is destroyed, so that they don't
+	// keep it in memory until they are due.
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		cast.wlock.Lock()
+		defer cast.wlock.Unlock()
+		if _, pending := cast.captionTimers[timer]; !pending {
+			return
+		}
+		delete(cast.captionTimers, timer)
+		if cast.textTrack == 0 {
+			return
+		}
+		ctc, rel := cast.sentTimecode, uint64(0)
+		// Try to fit into the current cluster to avoid going back in time.
+		if cast.sentClusterTimecode <= cast.sentTimecode && cast.sentTimecode-cast.sentClusterTimecode < 0x8000 {
+			ctc, rel = cast.sentClusterTimecode, cast.sentTimecode-cast.sentClusterTimecode
+		}
+		block := append(ebmlSize(cast.textTrack), byte(rel>>8), byte(rel), 0)
+		group := ebmlAppendTag(nil, ebmlTagBlock, append(block, text...))
+		group = ebmlAppendUint(group, ebmlTagBlockDuration, uint64(duration/time.Millisecond))
+		cast.send(ctc, frame{ebmlAppendTag(nil, ebmlTagBlockGroup, group), cast.textTrack, true})
+	})
+	cast.captionTimers[timer] = struct{}{}
+	return nil
+}
+
+// Wait until it's time to send a block with a given timecode. The write lock is released
+// while sleeping, so the only thing blocked is the broadcaster's connection.
+func (cast *Broadcast) pace(timecode uint64) {
+	now := time.Now()
+	due := cast.paceStart.Add(time.Duration(timecode-cast.paceBase) * time.Millisecond)
+	if timecode < cast.paceBase || due.Before(now.Add(-time.Second)) || due.After(now.Add(10*time.Second)) {
+		// Either the broadcaster can't keep up, or there was a gap in the stream. Either way,
+		// waiting would not help, so simply assume this block is on time.
+		cast.paceStart, cast.paceBase = now, timecode
+		return
+	}
+	cast.wlock.Unlock()
+	time.Sleep(due.Sub(now))
+	cast.wlock.Lock()
+}
+
+// Start looping the slate if nothing has been written for at least `delay`.
+func (cast *Broadcast) startSlate(delay time.Duration) {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	if cast.slateActive || cast.Closed || cast.sentClusterTimecode == 0xFFFFFFFFFFFFFFFF {
+		return // (nothing has been sent yet)
+	}
+	if time.Since(cast.lastWrite) < delay || !cast.Slate.Compatible(&cast.codecs) {
+		return
+	}
+	// A broadcaster that went away in the middle of a tag will not finish it;
+	// when it comes back, it starts over with a new EBML header.
+	cast.buffer = nil
+	cast.slateActive = true
+	cast.resync()
+	go cast.loopSlate()
+}
+
+func (cast *Broadcast) loopSlate() {
+	cast.wlock.Lock()
+	base := cast.sentTimecode + 1
+	cast.wlock.Unlock()
+
+	for start := time.Now(); ; start, base = start.Add(cast.Slate.duration), base+uint64(cast.Slate.duration/time.Millisecond) {
+		for _, f := range cast.Slate.frames {
+			time.Sleep(time.Until(start.Add(time.Duration(f.timecode) * time.Millisecond)))
+			cast.wlock.Lock()
+			if !cast.slateActive || cast.Closed {
+				cast.wlock.Unlock()
+				return
+			}
+			cast.sentTimecode = base + f.timecode
+			cast.send(base+f.cluster, f.frame)
+			cast.wlock.Unlock()
+		}
+		time.Sleep(time.Until(start.Add(cast.Slate.duration)))
+	}
+}
+
 func (cast *Broadcast) Write(data []byte) (int, error) {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	cast.lastWrite = time.Now()
 	cast.rateUnit += float64(len(data))
 	cast.buffer = append(cast.buffer, data...)
 
@@ -390,7 +869,27 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 		case ebmlTagVoid:
 			// Waste of space.
 		case ebmlTagTags:
-			// Maybe later.
+			tags := make(map[string]string)
+
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+				if tag2.ID == 0 {
+					return 0, errors.New("malformed EBML")
+				}
+				if tag2.ID == ebmlTagTag {
+					if err := ebmlParseSimpleTags(tag2.Contents(buf2), tags); err != nil {
+						return 0, err
+					}
+				}
+				buf2 = tag2.Skip(buf2)
+			}
+
+			cast.tags = tags
+			cast.tagsDirty = true
+			if cast.ForwardTags {
+				// Sending it now would cut the current cluster short; see `send`.
+				cast.pendingTags = append([]byte{}, buf...)
+			}
 		case ebmlTagCluster:
 			// Ignore boundaries, we'll regroup the data anyway.
 		case ebmlTagPrevSize:
@@ -404,6 +903,9 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 
 		case ebmlTagSegment:
 			cast.StreamTrackInfo = StreamTrackInfo{}
+			cast.codecs = [32]string{}
+			cast.videoTracks = 0
+			cast.textTrack = 0
 			// Always reset length to indeterminate.
 			cast.tracks = append([]byte{}, buf[0], buf[1], buf[2], buf[3], 0xFF)
 			// Will recalculate this when the first block arrives.
@@ -446,6 +948,8 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 			cast.tracks = append(cast.tracks, buf...)
 
 		case ebmlTagTrackEntry:
+			track, codec, video := uint64(0), "", false
+
 			for buf2 := tag.Contents(buf); len(buf2) != 0; {
 				tag2 := ebmlParseTag(buf2)
 
@@ -455,15 +959,19 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 
 				case ebmlTagTrackNumber:
 					// `viewer.seenKeyframes` is a 32-bit vector.
-					if fixedUint(tag2.Contents(buf2)) >= 32 {
+					if track = fixedUint(tag2.Contents(buf2)); track >= 32 {
 						return 0, errors.New("too many tracks")
 					}
 
+				case ebmlTagCodecID:
+					codec = string(tag2.Contents(buf2))
+
 				case ebmlTagAudio:
 					cast.HasAudio = true
 
 				case ebmlTagVideo:
 					cast.HasVideo = true
+					video = true
 					for buf3 := tag2.Contents(buf2); len(buf3) != 0; {
 						tag3 := ebmlParseTag(buf3)
 
@@ -485,53 +993,37 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 				buf2 = tag2.Skip(buf2)
 			}
 
+			if video {
+				cast.videoTracks |= 1 << track
+			}
+			cast.codecs[track] = codec
 			cast.tracks = append(cast.tracks, buf...)
 			cast.dirty = true
 
 		case ebmlTagTracks:
+			cast.tracksAt = len(cast.tracks)
 			cast.tracks = append(cast.tracks, buf...)
 
 		case ebmlTagTimecode:
 			cast.recvClusterTimecode = fixedUint(tag.Contents(buf)) + cast.timecodeShift
 
 		case ebmlTagBlockGroup, ebmlTagSimpleBlock:
-			key := false
-			block := tag.Contents(buf)
-
-			if tag.ID == ebmlTagBlockGroup {
-				key, block = true, nil
-
-				for buf2 := tag.Contents(buf); len(buf2) != 0; {
-					tag2 := ebmlParseTag(buf2)
-
-					switch tag2.ID {
-					case 0:
-						return 0, errors.New("malformed EBML")
-
-					case ebmlTagBlock:
-						block = tag2.Contents(buf2)
-
-					case ebmlTagReferenceBlock:
-						// Keyframes, by definition, have no reference frame.
-						key = fixedUint(tag2.Contents(buf2)) == 0
-					}
-
-					buf2 = tag2.Skip(buf2)
-				}
+			track, timecode, key, err := ebmlParseBlock(tag, buf)
+			if err != nil {
+				return 0, err
+			}
 
-				if block == nil {
-					return 0, errors.New("a BlockGroup contains no Blocks")
+			if cast.slateActive {
+				// Stay on the slate until the broadcaster sends something decodable.
+				if !key || (cast.videoTracks != 0 && cast.videoTracks&(1<<track) == 0) {
+					break
 				}
+				cast.slateActive = false
+				cast.resync()
+				// The slate has moved `sentTimecode` forward; the live stream must catch up.
+				cast.firstBlockInSegment = true
 			}
 
-			track, consumed := ebmlUint(block)
-			if consumed == 0 || track >= 32 || len(block) < consumed+3 {
-				return 0, errors.New("invalid track")
-			}
-			// This bit is always 0 in a Block, but 1 in a keyframe SimpleBlock.
-			key = key || block[consumed+2]&0x80 != 0
-			// Block timecodes are relative to cluster ones.
-			timecode := uint64(block[consumed+0])<<8 | uint64(block[consumed+1])
 			if cast.recvClusterTimecode+timecode < cast.sentTimecode {
 				// Allow non-monotonic blocks within a single segment (this simply means that
 				// coding order is not the same as display order)
@@ -544,35 +1036,14 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 				cast.sentTimecode = cast.recvClusterTimecode + timecode
 			}
 
-			ctc := cast.recvClusterTimecode
-			cluster := []byte{
-				// indeterminate length cluster
-				ebmlTagCluster >> 24 & 0xFF, ebmlTagCluster >> 16 & 0xFF, ebmlTagCluster >> 8 & 0xFF, ebmlTagCluster & 0xFF, 0xFF,
-				// first child: 8-byte timecode
-				ebmlTagTimecode, 0x88,
-				byte(ctc >> 56), byte(ctc >> 48), byte(ctc >> 40), byte(ctc >> 32),
-				byte(ctc >> 24), byte(ctc >> 16), byte(ctc >> 8), byte(ctc),
-			}
-			packed := frame{buf, track, key}
-
-			forceCluster := ctc != cast.sentClusterTimecode
-			cast.vlock.Lock()
-			for _, cb := range cast.viewers {
-				if !cb.skipHeaders {
-					if !cb.write(cast.header) || !cb.write(cast.tracks) {
-						continue // FIXME: if second write failed, the stream will not be a valid mkv
-					}
-					cb.skipHeaders = true
-					cast.frames.Read(cb.WriteFrame)
-				}
-				cb.WriteFrame(cluster, forceCluster, packed)
+			if cast.Captions && cast.textTrack == 0 {
+				// Tracks are complete by now, and no viewer has seen them yet.
+				cast.addTextTrack()
 			}
-			cast.vlock.Unlock()
-			if forceCluster {
-				cast.frames.PushCluster(cluster)
+			if cast.Paced {
+				cast.pace(cast.sentTimecode)
 			}
-			cast.frames.PushFrame(packed)
-			cast.sentClusterTimecode = ctc
+			cast.send(cast.recvClusterTimecode, frame{buf, track, key})
 			cast.firstBlockInSegment = false
 
 		default:
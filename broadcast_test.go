@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// An EBML element with an 8-byte size.
+func testTag(id uint64, contents ...[]byte) []byte {
+	var buf []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if id>>uint(shift) != 0 {
+			buf = append(buf, byte(id>>uint(shift)))
+		}
+	}
+	size := 0
+	for _, c := range contents {
+		size += len(c)
+	}
+	buf = append(buf, 0x01, 0, byte(size>>40), byte(size>>32), byte(size>>24), byte(size>>16), byte(size>>8), byte(size))
+	for _, c := range contents {
+		buf = append(buf, c...)
+	}
+	return buf
+}
+
+func testUint(id uint64, x uint64) []byte {
+	return testTag(id, []byte{byte(x >> 56), byte(x >> 48), byte(x >> 40), byte(x >> 32), byte(x >> 24), byte(x >> 16), byte(x >> 8), byte(x)})
+}
+
+// A WebM header with a single VP8 track, up to the first Cluster.
+func testWebMHeader() []byte {
+	buf := testTag(ebmlTagEBML, testTag(0x4282 /* DocType */, []byte("webm")))
+	buf = append(buf, ebmlTagSegment>>24&0xFF, ebmlTagSegment>>16&0xFF, ebmlTagSegment>>8&0xFF, ebmlTagSegment&0xFF, 0xFF)
+	buf = append(buf, testTag(ebmlTagInfo, testUint(ebmlTagTimecodeScale, 1000000))...)
+	return append(buf, testTag(ebmlTagTracks, testTag(ebmlTagTrackEntry,
+		testUint(ebmlTagTrackNumber, 1),
+		testTag(ebmlTagCodecID, []byte("V_VP8")),
+		testTag(ebmlTagVideo, testUint(ebmlTagPixelWidth, 640), testUint(ebmlTagPixelHeight, 360)),
+	))...)
+}
+
+func testWebMCluster(timecode uint64) []byte {
+	buf := []byte{ebmlTagCluster >> 24 & 0xFF, ebmlTagCluster >> 16 & 0xFF, ebmlTagCluster >> 8 & 0xFF, ebmlTagCluster & 0xFF, 0xFF}
+	return append(buf, testUint(ebmlTagTimecode, timecode)...)
+}
+
+func testWebMBlock(timecode uint16, key bool) []byte {
+	flags := byte(0)
+	if key {
+		flags = 0x80
+	}
+	return testTag(ebmlTagSimpleBlock, []byte{0x81, byte(timecode >> 8), byte(timecode), flags, 0})
+}
+
+func testBroadcast(t *testing.T, options BroadcastOptions) (*Broadcast, chan []byte) {
+	set := &BroadcastSet{Timeout: time.Second, SlateDelay: time.Hour, OnStreamOpen: func(id string, cast *Broadcast) {
+		cast.BroadcastOptions = options
+	}}
+	t.Cleanup(set.Shutdown)
+	cast, ok := set.Writable("test")
+	if !ok {
+		t.Fatal("could not open a stream")
+	}
+	ch := make(chan []byte, 1000)
+	cast.Connect(ch, false)
+	return cast, ch
+}
+
+func testWrite(t *testing.T, cast *Broadcast, data ...[]byte) {
+	for _, buf := range data {
+		if _, err := cast.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The timecodes of the blocks sent to a viewer so far.
+func testBlockTimecodes(t *testing.T, ch chan []byte) []uint64 {
+	var r []uint64
+	cluster := uint64(0)
+	for {
+		select {
+		case buf := <-ch:
+			switch tag := ebmlParseTagIncomplete(buf); tag.ID {
+			case ebmlTagCluster:
+				if tc := ebmlParseTag(buf[tag.Consumed:]); tc.ID == ebmlTagTimecode {
+					cluster = fixedUint(tc.Contents(buf[tag.Consumed:]))
+				}
+			case ebmlTagSimpleBlock:
+				_, timecode, _, err := ebmlParseBlock(tag, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = append(r, cluster+timecode)
+			}
+		default:
+			return r
+		}
+	}
+}
+
+func TestBroadcastConnectBlocking(t *testing.T) {
+	cast, _ := testBroadcast(t, BroadcastOptions{})
+	// Too small to hold everything, so a normal viewer would skip most of it.
+	ch := make(chan []byte, 1)
+	stop := make(chan struct{})
+	cast.ConnectBlocking(ch, stop)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		data := [][]byte{testWebMHeader(), testWebMCluster(0)}
+		for i := 0; i < 50; i++ {
+			data = append(data, testWebMBlock(uint16(i*10), i%10 == 0))
+		}
+		for _, buf := range data {
+			if _, err := cast.Write(buf); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	blocks := 0
+	for blocks < 50 {
+		select {
+		case buf := <-ch:
+			if ebmlParseTagIncomplete(buf).ID == ebmlTagSimpleBlock {
+				blocks++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected 50 blocks, got %d", blocks)
+		}
+	}
+	<-written
+	close(stop)
+	cast.Disconnect(ch)
+}
+
+func TestBroadcastTimecodeShift(t *testing.T) {
+	cast, ch := testBroadcast(t, BroadcastOptions{})
+	testWrite(t, cast, testWebMHeader(),
+		testWebMCluster(0), testWebMBlock(0, true), testWebMBlock(500, false),
+		testWebMCluster(1000), testWebMBlock(0, true))
+	// The broadcaster has reconnected and started counting from 0 again.
+	testWrite(t, cast, testWebMHeader(),
+		testWebMCluster(0), testWebMBlock(0, true),
+		testWebMCluster(500), testWebMBlock(0, false))
+	tcs := testBlockTimecodes(t, ch)
+	if len(tcs) != 5 || tcs[0] != 0 || tcs[1] != 500 || tcs[2] != 1000 || tcs[3] != 1000 || tcs[4] != 1500 {
+		t.Fatalf("expected blocks at [0 500 1000 1000 1500], got %v", tcs)
+	}
+}
+
+func TestBroadcastSlate(t *testing.T) {
+	slateData := append(testWebMHeader(), testWebMCluster(0)...)
+	slateData = append(slateData, testWebMBlock(0, true)...)
+	slateData = append(slateData, testWebMBlock(40, false)...)
+	slate, err := ParseSlate(slateData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cast, ch := testBroadcast(t, BroadcastOptions{Slate: slate})
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true), testWebMBlock(100, false))
+	cast.startSlate(0)
+	time.Sleep(200 * time.Millisecond)
+	// Blocks that can't be decoded without the ones before them are dropped.
+	testWrite(t, cast, testWebMCluster(200), testWebMBlock(0, false))
+	cast.wlock.Lock()
+	active := cast.slateActive
+	cast.wlock.Unlock()
+	if !active {
+		t.Fatal("a block that is not a keyframe ended the slate")
+	}
+	testWrite(t, cast, testWebMBlock(10, true))
+	cast.wlock.Lock()
+	active = cast.slateActive
+	cast.wlock.Unlock()
+	if active {
+		t.Fatal("a keyframe did not end the slate")
+	}
+	testWrite(t, cast, testWebMCluster(300), testWebMBlock(0, false))
+	tcs := testBlockTimecodes(t, ch)
+	if len(tcs) < 6 || tcs[1] != 100 || tcs[2] != 101 {
+		t.Fatalf("expected the slate to start at 101, got %v", tcs)
+	}
+	for i := 1; i < len(tcs); i++ {
+		if tcs[i] < tcs[i-1] {
+			t.Fatalf("timecodes went back from %d to %d: %v", tcs[i-1], tcs[i], tcs)
+		}
+	}
+}
+
+func TestBroadcastSlatePartialTag(t *testing.T) {
+	slateData := append(testWebMHeader(), testWebMCluster(0)...)
+	slateData = append(slateData, testWebMBlock(0, true)...)
+	slate, err := ParseSlate(slateData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cast, ch := testBroadcast(t, BroadcastOptions{Slate: slate})
+	block := testWebMBlock(100, false)
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true), block[:len(block)/2])
+	// The broadcaster has dropped in the middle of a block.
+	cast.startSlate(0)
+	cast.wlock.Lock()
+	active := cast.slateActive
+	cast.wlock.Unlock()
+	if !active {
+		t.Fatal("the slate did not start after a partial tag")
+	}
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true))
+	cast.wlock.Lock()
+	active = cast.slateActive
+	cast.wlock.Unlock()
+	if active {
+		t.Fatal("the broadcaster could not resume after a partial tag")
+	}
+	if tcs := testBlockTimecodes(t, ch); len(tcs) < 2 || tcs[0] != 0 {
+		t.Fatalf("expected the first keyframe, the slate, and the resumed stream, got %v", tcs)
+	}
+}
+
+func TestBroadcastPaced(t *testing.T) {
+	cast, ch := testBroadcast(t, BroadcastOptions{Paced: true})
+	start := time.Now()
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true), testWebMBlock(300, false))
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("a block 300 ms into the stream was sent after %v", elapsed)
+	}
+	// A gap in the stream is not waited out.
+	start = time.Now()
+	testWrite(t, cast, testWebMCluster(60000), testWebMBlock(0, true))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("a block after a gap was delayed by %v", elapsed)
+	}
+	if tcs := testBlockTimecodes(t, ch); len(tcs) != 3 {
+		t.Fatalf("expected 3 blocks, got %v", tcs)
+	}
+}
+
+func TestBroadcastCaption(t *testing.T) {
+	if err := (&Broadcast{}).Caption("hello", 0, time.Second); err != ErrNoCaptions {
+		t.Fatalf("expected ErrNoCaptions, got %v", err)
+	}
+	cast, ch := testBroadcast(t, BroadcastOptions{Captions: true})
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true), testWebMBlock(100, false))
+	if err := cast.Caption("hello", 0, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	tracks, caption := false, false
+	for len(ch) > 0 {
+		buf := <-ch
+		tracks = tracks || bytes.Contains(buf, []byte("S_TEXT/WEBVTT"))
+		if tag := ebmlParseTagIncomplete(buf); tag.ID == ebmlTagBlockGroup {
+			caption = bytes.HasSuffix(ebmlParseTag(tag.Contents(buf)).Contents(tag.Contents(buf)), []byte("hello"))
+		}
+	}
+	if !tracks || !caption {
+		t.Fatalf("expected a text track (%v) and a caption on it (%v)", tracks, caption)
+	}
+}
+
+func TestBroadcastCaptionDropped(t *testing.T) {
+	cast, _ := testBroadcast(t, BroadcastOptions{Captions: true})
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true))
+	if err := cast.Caption("much later", time.Hour, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	close(cast.destroy)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		cast.wlock.Lock()
+		closed, pending := cast.Closed, len(cast.captionTimers)
+		cast.wlock.Unlock()
+		if closed {
+			if pending != 0 {
+				t.Fatalf("%d captions are still waiting after the stream was destroyed", pending)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the stream was not destroyed")
+		}
+	}
+}
+
+func TestBroadcastTags(t *testing.T) {
+	cast, _ := testBroadcast(t, BroadcastOptions{})
+	title := testTag(ebmlTagTag,
+		testTag(ebmlTagTargets, testTag(ebmlTagTargetType, []byte("MOVIE"))),
+		testTag(ebmlTagSimpleTag, testTag(ebmlTagTagName, []byte("TITLE")), testTag(ebmlTagTagString, []byte("Hello"))))
+	// Tags of individual tracks are not metadata of the stream.
+	encoder := testTag(ebmlTagTag,
+		testTag(ebmlTagTargets, testUint(ebmlTagTagTrackUID, 1)),
+		testTag(ebmlTagSimpleTag, testTag(ebmlTagTagName, []byte("ENCODER")), testTag(ebmlTagTagString, []byte("x"))))
+	testWrite(t, cast, testWebMHeader(), testTag(ebmlTagTags, title, encoder), testWebMCluster(0), testWebMBlock(0, true))
+	if tags := cast.Tags(); len(tags) != 1 || tags["TITLE"] != "Hello" {
+		t.Fatalf("expected only TITLE=Hello, got %v", tags)
+	}
+}
+
+func TestBroadcastForwardTags(t *testing.T) {
+	cast, ch := testBroadcast(t, BroadcastOptions{ForwardTags: true})
+	title := testTag(ebmlTagTag,
+		testTag(ebmlTagTargets, testTag(ebmlTagTargetType, []byte("MOVIE"))),
+		testTag(ebmlTagSimpleTag, testTag(ebmlTagTagName, []byte("TITLE")), testTag(ebmlTagTagString, []byte("Hello"))))
+	testWrite(t, cast, testWebMHeader(), testWebMCluster(0), testWebMBlock(0, true),
+		testTag(ebmlTagTags, title), testWebMBlock(100, false),
+		testWebMCluster(1000), testWebMBlock(0, false))
+	var ids []uint
+	for len(ch) > 0 {
+		ids = append(ids, ebmlParseTagIncomplete(<-ch).ID)
+	}
+	// Tags in the middle of a cluster would end it, so they wait for the next one.
+	expect := []uint{ebmlTagEBML, ebmlTagSegment, ebmlTagCluster, ebmlTagSimpleBlock, ebmlTagSimpleBlock, ebmlTagTags, ebmlTagCluster, ebmlTagSimpleBlock}
+	if len(ids) != len(expect) {
+		t.Fatalf("expected %x, got %x", expect, ids)
+	}
+	for i := range ids {
+		if ids[i] != expect[i] {
+			t.Fatalf("expected %x, got %x", expect, ids)
+		}
+	}
+}
+
+func TestBroadcastShutdown(t *testing.T) {
+	closed := make(chan string, 2)
+	set := &BroadcastSet{Timeout: time.Hour, OnStreamClose: func(id string) {
+		closed <- id
+	}}
+	a, _ := set.Writable("a")
+	set.Writable("b")
+	// Waiting for the broadcaster to reconnect.
+	a.Close()
+	done := make(chan struct{})
+	go func() {
+		set.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streams were not destroyed")
+	}
+	if len(closed) != 2 {
+		t.Fatalf("expected both streams to be closed, got %d", len(closed))
+	}
+	if _, ok := set.Writable("c"); ok {
+		t.Fatal("opened a stream after shutting down")
+	}
+}
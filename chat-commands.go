@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Messages starting with a slash are commands. Built-in ones are listed here; the owner
+// can also define commands that simply show a notice (see `commandCommand`).
+type chatCommand struct {
+	role  ChatRole
+	usage string
+	run   func(ctx *chatter, args string) error
+}
+
+var chatCommands map[string]chatCommand
+
+func init() {
+	chatCommands = map[string]chatCommand{
+		"me":      {ChatUser, "/me <action>", (*chatter).commandMe},
+		"w":       {ChatUser, "/w <name> <message>", (*chatter).commandWhisper},
+		"ban":     {ChatModerator, "/ban <name>", (*chatter).commandBan},
+		"timeout": {ChatModerator, "/timeout <name> [seconds]", (*chatter).commandTimeout},
+		"clear":   {ChatModerator, "/clear", (*chatter).commandClear},
+		"poll":    {ChatModerator, "/poll <seconds> <question> | <option> | <option>...", (*chatter).commandPoll},
+		"endpoll": {ChatModerator, "/endpoll", (*chatter).commandEndPoll},
+		"slow":    {ChatOwner, "/slow <seconds|off>", (*chatter).commandSlow},
+		"command": {ChatOwner, "/command <name> [response]", (*chatter).commandCommand},
+	}
+}
+
+// The default duration of `/timeout`, in seconds.
+const chatDefaultTimeout = 600
+
+// Sent by `/w` or `Whisper`. Relays receive all whispers and deliver them to their
+// own users. Whispers are not saved anywhere.
+type chatWhisper RPCWhisperArg
+
+// Sent by `/clear`, with the name of the moderator who did it.
+type chatClear string
+
+// The first four fields are the parameters of `Chat.Whisper`; the other two
+// identify the recipient, and are only sent to relays.
+type RPCWhisperArg struct {
+	From    string
+	To      string
+	Text    string
+	Login   string
+	ToLogin string
+	ToAnon  string
+}
+
+func (x *RPCWhisperArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.From, &x.To, &x.Text, &x.Login, &x.ToLogin, &x.ToAnon}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+type RPCWhisperToArg struct {
+	Name string
+	Text string
+}
+
+func (x *RPCWhisperToArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Name, &x.Text}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+func errUsage(cmd chatCommand) error {
+	return errors.New("usage: " + cmd.usage)
+}
+
+// Split off the first word.
+func splitCommand(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexFunc(text, unicode.IsSpace); i != -1 {
+		return text[:i], strings.TrimSpace(text[i:])
+	}
+	return text, ""
+}
+
+func (ctx *chatter) runCommand(text string) error {
+	name, args := splitCommand(text)
+	name = strings.ToLower(name)
+	cmd, ok := chatCommands[name]
+	if !ok {
+		return ctx.customCommand(name)
+	}
+	if err := ctx.requireRole(cmd.role, errors.New("you are not allowed to use /"+name)); err != nil {
+		return err
+	}
+	return cmd.run(ctx, args)
+}
+
+func (ctx *chatter) customCommand(name string) error {
+	text := ""
+	if ctx.chat.db != nil && name != "" {
+		var err error
+		if text, err = ctx.chat.db.GetChatCommand(ctx.chat.stream, name); err != nil {
+			return err
+		}
+	}
+	if text == "" {
+		return errors.New("unknown command: /" + name)
+	}
+	if err := ctx.limits().allow("/"+name, 0); err != nil {
+		return err
+	}
+	return ctx.chat.notice(text)
+}
+
+// Show a line of text to everyone, not attributed to anyone in particular.
+func (c *Chat) notice(text string) error {
+	return c.broadcast(chatNotification{"Chat.Notice", []interface{}{text}}, "Relay.Notice", text)
+}
+
+// Find out who someone is from their name in the chat.
+func (ctx *chatter) resolveName(name string) (string, string, error) {
+	if ctx.chat.db == nil {
+		return "", "", ErrNotSupported
+	}
+	login, anon, err := ctx.chat.db.GetChatNameOwner(ctx.chat.stream, name)
+	if err == ErrUserNotExist {
+		return "", "", errors.New("nobody here is called " + name)
+	}
+	return login, anon, err
+}
+
+func (ctx *chatter) commandMe(args string) error {
+	return ctx.send(ChatMessage{name: ctx.name, login: ctx.login, text: args, anon: ctx.anon, action: true, bot: ctx.bot})
+}
+
+func (ctx *chatter) commandWhisper(args string) error {
+	to, text := splitCommand(args)
+	if to == "" || text == "" {
+		return errUsage(chatCommands["w"])
+	}
+	return ctx.whisper(to, text)
+}
+
+func (ctx *chatter) Whisper(args *RPCWhisperToArg, _ *interface{}) error {
+	if ctx.name == "" {
+		return errors.New("must obtain a name first")
+	}
+	return ctx.whisper(strings.TrimSpace(args.Name), args.Text)
+}
+
+// Send a message to all connections of the user who has the name `to`, and show it
+// to the sender on this connection.
+func (ctx *chatter) whisper(to string, text string) error {
+	if len(text) == 0 || len(text) > 256 {
+		return errors.New("message must have between 1 and 256 characters")
+	}
+	toLogin, toAnon, err := ctx.resolveName(to)
+	if err != nil {
+		return err
+	}
+	if err := ctx.chat.checkBan(ctx.login, ctx.anon); err != nil {
+		return err
+	}
+	blocked, err := ctx.chat.db.IsChatUserBlocked(toLogin, toAnon, ctx.login, ctx.anon)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return errors.New(to + " does not accept whispers from you")
+	}
+	if err := ctx.limits().allow(text, 0); err != nil {
+		return err
+	}
+	event := chatWhisper{ctx.name, to, text, ctx.login, toLogin, toAnon}
+	if err := ctx.chat.broadcast(event, "Relay.Whisper", event.params(true)...); err != nil {
+		return err
+	}
+	if !event.to(ctx) {
+		// Whispering to oneself is strange, but that would be a duplicate.
+		RPCPushEvent(ctx.socket, "Chat.Whisper", event.params(false)...)
+	}
+	return nil
+}
+
+func (event chatWhisper) to(u *chatter) bool {
+	if event.ToLogin != "" {
+		return u.login == event.ToLogin
+	}
+	return u.login == "" && u.anon == event.ToAnon
+}
+
+func (event chatWhisper) params(relay bool) []interface{} {
+	if relay {
+		return []interface{}{event.From, event.To, event.Text, event.Login, event.ToLogin, event.ToAnon}
+	}
+	return []interface{}{event.From, event.To, event.Text, event.Login}
+}
+
+// Stop receiving whispers from whoever has this name now, including once they
+// change it. The list belongs to the user (or anonymous session), not the room.
+func (ctx *chatter) Block(args *RPCSingleStringArg, _ *interface{}) error {
+	login, anon, err := ctx.resolveName(strings.TrimSpace(args.First))
+	if err != nil {
+		return err
+	}
+	if (chatWhisper{ToLogin: login, ToAnon: anon}).to(ctx) {
+		return errors.New("cannot block yourself")
+	}
+	return ctx.chat.db.AddChatBlock(ctx.login, ctx.anon, strings.TrimSpace(args.First), login, anon)
+}
+
+// Undo a `Block` by the name the user had at the time.
+func (ctx *chatter) Unblock(args *RPCSingleStringArg, _ *interface{}) error {
+	if ctx.chat.db == nil {
+		return ErrNotSupported
+	}
+	return ctx.chat.db.DelChatBlock(ctx.login, ctx.anon, strings.TrimSpace(args.First))
+}
+
+func (ctx *chatter) commandBan(args string) error {
+	name, rest := splitCommand(args)
+	if name == "" || rest != "" {
+		return errUsage(chatCommands["ban"])
+	}
+	login, anon, err := ctx.resolveName(name)
+	if err == nil {
+		err = ctx.ban(login, anon, 0)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.chat.notice(name + " has been banned.")
+}
+
+func (ctx *chatter) commandTimeout(args string) error {
+	name, rest := splitCommand(args)
+	seconds, err := chatDefaultTimeout, error(nil)
+	if rest != "" {
+		seconds, err = strconv.Atoi(rest)
+	}
+	if name == "" || err != nil || seconds <= 0 {
+		return errUsage(chatCommands["timeout"])
+	}
+	login, anon, err := ctx.resolveName(name)
+	if err == nil {
+		err = ctx.ban(login, anon, seconds)
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.chat.notice(name + " has been timed out for " + strconv.Itoa(seconds) + " seconds.")
+}
+
+func (ctx *chatter) commandClear(args string) error {
+	// Or else `RequestHistory` would bring the messages back.
+	if err := ctx.chat.db.ClearChatHistory(ctx.chat.stream); err != nil {
+		return err
+	}
+	return ctx.chat.broadcast(chatClear(ctx.name), "Relay.Clear", ctx.name)
+}
+
+func (ctx *chatter) commandSlow(args string) error {
+	seconds, err := strconv.Atoi(args)
+	if args == "off" {
+		seconds, err = 0, nil
+	}
+	if err != nil {
+		return errUsage(chatCommands["slow"])
+	}
+	return ctx.setSlowMode(seconds)
+}
+
+// Define a custom command, or remove it if there is no response.
+func (ctx *chatter) commandCommand(args string) error {
+	name, text := splitCommand(args)
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+	if name == "" || len(name) > 32 {
+		return errUsage(chatCommands["command"])
+	}
+	for _, c := range name {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != '_' {
+			return errors.New("command names can only contain letters, digits, '-', and '_'")
+		}
+	}
+	if _, ok := chatCommands[name]; ok {
+		return errors.New("/" + name + " is a built-in command")
+	}
+	if len(text) > 256 {
+		return errors.New("the response must be at most 256 characters long")
+	}
+	return ctx.chat.db.SetChatCommand(ctx.chat.stream, name, text)
+}
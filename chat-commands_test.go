@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for _, c := range []struct{ text, name, args string }{
+		{"", "", ""},
+		{"clear", "clear", ""},
+		{"  clear  ", "clear", ""},
+		{"w bob hi there", "w", "bob hi there"},
+		{"w\tbob  hi  there ", "w", "bob  hi  there"},
+		{"poll 60 Yes? | yes | no", "poll", "60 Yes? | yes | no"},
+	} {
+		if name, args := splitCommand(c.text); name != c.name || args != c.args {
+			t.Errorf("%q: expected (%q, %q), got (%q, %q)", c.text, c.name, c.args, name, args)
+		}
+	}
+}
+
+func TestChatCommandRoles(t *testing.T) {
+	for name, role := range map[string]ChatRole{
+		"me": ChatUser, "w": ChatUser, "ban": ChatModerator, "timeout": ChatModerator,
+		"clear": ChatModerator, "poll": ChatModerator, "endpoll": ChatModerator,
+		"slow": ChatOwner, "command": ChatOwner,
+	} {
+		if cmd, ok := chatCommands[name]; !ok || cmd.role != role {
+			t.Errorf("/%s: expected role %d, got %d", name, role, cmd.role)
+		}
+	}
+}
+
+func TestChatCommandUnknown(t *testing.T) {
+	ctx := &chatter{chat: &Chat{}}
+	if err := ctx.runCommand("nosuchthing"); err == nil || err.Error() != "unknown command: /nosuchthing" {
+		t.Fatalf("expected an unknown command, got %v", err)
+	}
+	if err := ctx.runCommand(""); err == nil || err.Error() != "unknown command: /" {
+		t.Fatalf("expected an unknown command, got %v", err)
+	}
+	if err := ctx.runCommand("ban someone"); err == nil || err.Error() != "you are not allowed to use /ban" {
+		t.Fatalf("expected a permission error, got %v", err)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The code of the error returned by `SendMessage` if a filter rejects the message.
+const rpcErrFiltered = -32005
+
+const (
+	chatMaxFilterRules = 100
+	// Short messages are not checked for capital letters, as "OK" is not shouting.
+	chatCapsMinLetters = 8
+)
+
+var chatLinkRegexp = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+|\b(?:[a-z0-9-]+\.)+(?:com|net|org|info|io|tv|gg|me|ly|co|ru|de|uk)\b(?:/\S*)?`)
+
+// Sent once the owner's chat has reloaded the filters, so that relays reload them too.
+type chatFilters struct{}
+
+// A notification for moderators only, and relays, who pass it on to their moderators.
+type chatModNotification chatNotification
+
+// The filters of a room, ready to use.
+type chatFilterSet struct {
+	ChatFilters
+	patterns []*regexp.Regexp // One for each rule; nil if it is somehow invalid.
+}
+
+type RPCFilterRuleArg struct {
+	Pattern string
+	Regex   bool
+	Action  ChatFilterAction
+}
+
+func (x *RPCFilterRuleArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Pattern, &x.Regex, &x.Action}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+type RPCFilterPolicyArg struct {
+	Value  int
+	Action ChatFilterAction
+}
+
+func (x *RPCFilterPolicyArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Value, &x.Action}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// A notification's name followed by its parameters.
+type RPCNotificationArg chatNotification
+
+func (x *RPCNotificationArg) UnmarshalJSON(buf []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) == 0 || json.Unmarshal(fields[0], &x.method) != nil {
+		return errors.New("invalid number of arguments")
+	}
+	for _, p := range fields[1:] {
+		x.params = append(x.params, p)
+	}
+	return nil
+}
+
+func (action ChatFilterAction) valid() bool {
+	return action == ChatFilterReject || action == ChatFilterMask || action == ChatFilterHold
+}
+
+func (rule ChatFilterRule) compile() (*regexp.Regexp, error) {
+	if rule.Regex {
+		return regexp.Compile(rule.Pattern)
+	}
+	// Match whole words only, so that blocking "ass" does not also block "class".
+	pattern := regexp.QuoteMeta(rule.Pattern)
+	if first, _ := utf8.DecodeRuneInString(rule.Pattern); isWordRune(first) {
+		pattern = `\b` + pattern
+	}
+	if last, _ := utf8.DecodeLastRuneInString(rule.Pattern); isWordRune(last) {
+		pattern = pattern + `\b`
+	}
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// What `\b` considers a part of a word.
+func isWordRune(r rune) bool {
+	return r < utf8.RuneSelf && (r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func compileChatFilters(f *ChatFilters) *chatFilterSet {
+	set := &chatFilterSet{ChatFilters: *f, patterns: make([]*regexp.Regexp, len(f.Rules))}
+	for i, rule := range f.Rules {
+		var err error
+		if set.patterns[i], err = rule.compile(); err != nil {
+			log.Println("Invalid chat filter: ", err)
+		}
+	}
+	return set
+}
+
+func maskChatText(s string) string {
+	return strings.Repeat("*", utf8.RuneCountInString(s))
+}
+
+func tooManyCaps(text string, percent int) bool {
+	letters, caps := 0, 0
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			if letters++; unicode.IsUpper(r) {
+				caps++
+			}
+		}
+	}
+	return letters >= chatCapsMinLetters && caps*100 > letters*percent
+}
+
+// Check a message sent by someone with a given role. Returns the text, possibly
+// masked, and if the message should be held, the reason why.
+func (f *chatFilterSet) apply(text string, role ChatRole) (string, string, error) {
+	hold := ""
+	check := func(found bool, action ChatFilterAction, reason string, mask func(string) string) error {
+		if !found {
+			return nil
+		}
+		switch action {
+		case ChatFilterMask:
+			text = mask(text)
+		case ChatFilterHold:
+			if hold == "" {
+				hold = reason
+			}
+		default:
+			return jsonrpc2.NewError(rpcErrFiltered, reason)
+		}
+		return nil
+	}
+	for i, re := range f.patterns {
+		if re == nil {
+			continue
+		}
+		mask := func(s string) string { return re.ReplaceAllStringFunc(s, maskChatText) }
+		if err := check(re.MatchString(text), f.Rules[i].Action, "your message contains a blocked word", mask); err != nil {
+			return "", "", err
+		}
+	}
+	if f.Links == ChatLinksDisallowed || (f.Links == ChatLinksModerators && role < ChatModerator) {
+		mask := func(s string) string { return chatLinkRegexp.ReplaceAllStringFunc(s, maskChatText) }
+		if err := check(chatLinkRegexp.MatchString(text), f.LinkAction, "links are not allowed", mask); err != nil {
+			return "", "", err
+		}
+	}
+	if f.MaxCaps > 0 {
+		if err := check(tooManyCaps(text, f.MaxCaps), f.CapsAction, "too many capital letters", strings.ToLower); err != nil {
+			return "", "", err
+		}
+	}
+	return text, hold, nil
+}
+
+// The filters that apply to messages in this room, or nil if there are none.
+func (c *Chat) Filters() *chatFilterSet {
+	set, _ := c.filters.Load().(*chatFilterSet)
+	return set
+}
+
+func (c *Chat) loadFilters() {
+	if c.db == nil {
+		return
+	}
+	f, err := c.db.GetChatFilters(c.stream)
+	if err != nil {
+		log.Println("Error loading chat filters: ", err)
+		return
+	}
+	c.filters.Store(compileChatFilters(f))
+}
+
+// (owner only) Return the current filters.
+func (ctx *chatter) GetFilters(_ *interface{}, reply *ChatFilters) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change filters")); err != nil {
+		return err
+	}
+	f, err := ctx.chat.db.GetChatFilters(ctx.chat.stream)
+	if err == nil {
+		*reply = *f
+	}
+	return err
+}
+
+// (owner only) Add a blocked word, phrase, or regular expression; returns the ID of the rule.
+func (ctx *chatter) AddFilter(args *RPCFilterRuleArg, reply *int64) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change filters")); err != nil {
+		return err
+	}
+	rule := ChatFilterRule{Pattern: strings.TrimSpace(args.Pattern), Regex: args.Regex, Action: args.Action}
+	if len(rule.Pattern) == 0 || len(rule.Pattern) > 256 {
+		return errors.New("the pattern must have between 1 and 256 characters")
+	}
+	if !rule.Action.valid() {
+		return errors.New("unknown action")
+	}
+	if _, err := rule.compile(); err != nil {
+		return errors.New("invalid regular expression")
+	}
+	if set := ctx.chat.Filters(); set != nil && len(set.Rules) >= chatMaxFilterRules {
+		return errors.New("too many filters")
+	}
+	id, err := ctx.chat.db.AddChatFilterRule(ctx.chat.stream, rule)
+	if err != nil {
+		return err
+	}
+	*reply = id
+	return ctx.chat.filtersChanged()
+}
+
+func (ctx *chatter) RemoveFilter(args *RPCSingleIntArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change filters")); err != nil {
+		return err
+	}
+	if err := ctx.chat.db.DelChatFilterRule(ctx.chat.stream, int64(args.First)); err != nil {
+		return err
+	}
+	return ctx.chat.filtersChanged()
+}
+
+// (owner only) Allow links from everyone, moderators only, or nobody but the owner.
+func (ctx *chatter) SetLinkPolicy(args *RPCFilterPolicyArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change filters")); err != nil {
+		return err
+	}
+	policy := ChatLinkPolicy(args.Value)
+	if policy != ChatLinksAllowed && policy != ChatLinksModerators && policy != ChatLinksDisallowed {
+		return errors.New("unknown link policy")
+	}
+	if !args.Action.valid() {
+		return errors.New("unknown action")
+	}
+	if err := ctx.chat.db.SetChatLinkPolicy(ctx.chat.stream, policy, args.Action); err != nil {
+		return err
+	}
+	return ctx.chat.filtersChanged()
+}
+
+// (owner only) Limit the percentage of capital letters in a message; 0 for no limit.
+func (ctx *chatter) SetCapsLimit(args *RPCFilterPolicyArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change filters")); err != nil {
+		return err
+	}
+	if args.Value < 0 || args.Value > 100 {
+		return errors.New("the limit must be between 0 and 100 percent")
+	}
+	if !args.Action.valid() {
+		return errors.New("unknown action")
+	}
+	if err := ctx.chat.db.SetChatCapsLimit(ctx.chat.stream, args.Value, args.Action); err != nil {
+		return err
+	}
+	return ctx.chat.filtersChanged()
+}
+
+// Reload the filters after the owner has changed them, and tell the relays to do the same.
+func (c *Chat) filtersChanged() error {
+	if c.upstream != nil {
+		return c.callUpstream("Relay.Filters")
+	}
+	c.loadFilters()
+	c.post(chatFilters{})
+	return nil
+}
+
+func (ctx chatRelay) Filters(_ *interface{}, _ *interface{}) error {
+	return ctx.chat.filtersChanged()
+}
+
+// Save a message for moderators to review, and let the author know.
+func (ctx *chatter) hold(msg ChatMessage, reason string) error {
+	id, err := ctx.chat.db.AddHeldMessage(ctx.chat.stream, msg.stored(), reason)
+	if err != nil {
+		return err
+	}
+	held := StreamHeldMessage{*msg.stored(), reason}
+	held.ID = id
+	if err := ctx.chat.notifyModerators("Chat.MessageHeld", heldParams(held)...); err != nil {
+		return err
+	}
+	return RPCPushEvent(ctx.socket, "Chat.Notice", "Your message will be shown once a moderator approves it.")
+}
+
+func heldParams(msg StreamHeldMessage) []interface{} {
+	return []interface{}{msg.ID, msg.Name, msg.Text, msg.Login, msg.Action, msg.Anon, msg.Reason}
+}
+
+func (c *Chat) notifyModerators(method string, params ...interface{}) error {
+	event := chatModNotification{method, params}
+	return c.broadcast(event, "Relay.ModNotify", append([]interface{}{method}, params...)...)
+}
+
+func (ctx chatRelay) ModNotify(args *RPCNotificationArg, _ *interface{}) error {
+	ctx.chat.post(chatModNotification(*args))
+	return nil
+}
+
+// Show messages that are waiting for approval to a moderator who has just connected.
+func (ctx *chatter) pushHeld() error {
+	if ctx.role() < ChatModerator {
+		return nil
+	}
+	held, err := ctx.chat.db.GetHeldMessages(ctx.chat.stream)
+	for _, msg := range held {
+		if err := RPCPushEvent(ctx.socket, "Chat.MessageHeld", heldParams(msg)...); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// (moderators only) Show a held message to everyone.
+func (ctx *chatter) ApproveMessage(args *RPCSingleIntArg, _ *interface{}) error {
+	return ctx.resolveHeld(int64(args.First), true)
+}
+
+// (moderators only) Discard a held message.
+func (ctx *chatter) RejectMessage(args *RPCSingleIntArg, _ *interface{}) error {
+	return ctx.resolveHeld(int64(args.First), false)
+}
+
+func (ctx *chatter) resolveHeld(id int64, approve bool) error {
+	if err := ctx.requireRole(ChatModerator, errNotModerator); err != nil {
+		return err
+	}
+	held, err := ctx.chat.db.TakeHeldMessage(ctx.chat.stream, id)
+	if err != nil {
+		return err
+	}
+	if err := ctx.chat.notifyModerators("Chat.HeldResolved", id, approve); err != nil || !approve {
+		return err
+	}
+	held.ID = 0 // It gets a new one when saved as a normal message.
+	return ctx.chat.broadcastMessage(chatMessageFrom(held.StreamChatMessage))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"testing"
+)
+
+func TestChatFilterWords(t *testing.T) {
+	f := compileChatFilters(&ChatFilters{Rules: []ChatFilterRule{
+		{Pattern: "ass", Action: ChatFilterMask},
+		{Pattern: "c++", Action: ChatFilterMask},
+		{Pattern: `^\d+$`, Regex: true, Action: ChatFilterReject},
+		{Pattern: "buy now", Action: ChatFilterHold},
+	}})
+	for _, c := range []struct {
+		text, result, hold string
+		rejected           bool
+	}{
+		{"a classic", "a classic", "", false},
+		{"you ASS", "you ***", "", false},
+		{"ass, and more ass", "***, and more ***", "", false},
+		{"I write c++ daily", "I write *** daily", "", false},
+		{"12345", "", "", true},
+		{"12345 apples", "12345 apples", "", false},
+		{"Buy Now!", "Buy Now!", "your message contains a blocked word", false},
+	} {
+		result, hold, err := f.apply(c.text, ChatUser)
+		if c.rejected {
+			if e, ok := err.(*jsonrpc2.Error); !ok || e.Code != rpcErrFiltered {
+				t.Errorf("%q: expected to be rejected, got %v", c.text, err)
+			}
+			continue
+		}
+		if err != nil || result != c.result || hold != c.hold {
+			t.Errorf("%q: expected %q (held: %q), got %q (held: %q, error: %v)", c.text, c.result, c.hold, result, hold, err)
+		}
+	}
+}
+
+func TestChatFilterInvalidRegex(t *testing.T) {
+	f := compileChatFilters(&ChatFilters{Rules: []ChatFilterRule{{Pattern: "(", Regex: true}}})
+	if result, _, err := f.apply("(", ChatUser); err != nil || result != "(" {
+		t.Fatalf("an invalid rule should be skipped, got %q, %v", result, err)
+	}
+}
+
+func TestChatFilterLinks(t *testing.T) {
+	f := compileChatFilters(&ChatFilters{Links: ChatLinksModerators, LinkAction: ChatFilterMask})
+	text := "see example.com/page or https://example.org"
+	if result, _, _ := f.apply(text, ChatUser); result != "see **************** or *******************" {
+		t.Errorf("links were not masked: %q", result)
+	}
+	if result, _, _ := f.apply(text, ChatModerator); result != text {
+		t.Errorf("links from moderators were masked: %q", result)
+	}
+	if result, _, _ := f.apply("e.g. this is fine", ChatUser); result != "e.g. this is fine" {
+		t.Errorf("not a link, but masked anyway: %q", result)
+	}
+	f.Links = ChatLinksDisallowed
+	if result, _, _ := f.apply(text, ChatModerator); result == text {
+		t.Errorf("links from moderators were not masked")
+	}
+}
+
+func TestChatFilterCaps(t *testing.T) {
+	f := compileChatFilters(&ChatFilters{MaxCaps: 50, CapsAction: ChatFilterMask})
+	for text, result := range map[string]string{
+		"OK":                   "OK",
+		"THIS IS LOUD":         "this is loud",
+		"This Is Not So Loud":  "This Is Not So Loud",
+		"ÜBER LOUD, NOT ASCII": "über loud, not ascii",
+	} {
+		if got, _, _ := f.apply(text, ChatUser); got != result {
+			t.Errorf("%q: expected %q, got %q", text, result, got)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every chatter can send `chatBurst` messages at once, then `chatRate` per second.
+// Running into the limit `chatStrikes` times in a row mutes them for a while.
+const (
+	chatBurst        = 5
+	chatRate         = 1.0
+	chatStrikes      = 3
+	chatMuteDuration = time.Minute
+	// Sending the same text twice within this interval is probably an accident (or spam).
+	chatRepeatWindow = 30 * time.Second
+	chatMaxSlowMode  = 3600
+	// Bots often answer several commands at once, so they get more room.
+	chatBotBurst = 20
+	chatBotRate  = 2.0
+)
+
+// Codes of errors returned by `SendMessage`. If the client can try again later,
+// the error's `data` is the number of seconds to wait.
+const (
+	rpcErrRateLimited = -32001
+	rpcErrSlowMode    = -32002
+	rpcErrRepeated    = -32003
+	rpcErrMuted       = -32004
+)
+
+// Sent when the owner changes the minimum interval between messages.
+type chatSlowMode int
+
+type chatLimiter struct {
+	bot     bool // Use `chatBotBurst` and `chatBotRate` instead.
+	lock    sync.Mutex
+	tokens  float64
+	updated time.Time
+	strikes int
+	muted   time.Time
+	// The last accepted message.
+	text string
+	sent time.Time
+}
+
+// Find the limiter of whoever is behind `key`. Those that have been idle for long enough
+// to be no different from new ones are forgotten.
+func (c *Chat) limiter(key string, bot bool) *chatLimiter {
+	c.limitLock.Lock()
+	defer c.limitLock.Unlock()
+	if l, ok := c.limiters[key]; ok {
+		return l
+	}
+	now := time.Now()
+	for k, l := range c.limiters {
+		if l.expired(now) {
+			delete(c.limiters, k)
+		}
+	}
+	l := &chatLimiter{bot: bot}
+	c.limiters[key] = l
+	return l
+}
+
+// Relays don't need one, as their users are limited by the relaying node.
+func (ctx *chatter) limits() *chatLimiter {
+	return ctx.chat.limiter(ctx.limitKey(), ctx.bot)
+}
+
+// Who is sending the messages. Connections without a session cookie would get
+// a new session by reconnecting, so they are told apart by address instead.
+// Bots have their own limits, even if their owner is chatting too.
+func (ctx *chatter) limitKey() string {
+	if ctx.login != "" {
+		if ctx.bot {
+			return "bot:" + ctx.login
+		}
+		return "login:" + ctx.login
+	}
+	if ctx.transient && ctx.socket != nil && ctx.socket.Request() != nil {
+		host, _, _ := net.SplitHostPort(ctx.socket.Request().RemoteAddr)
+		return "addr:" + host
+	}
+	return "anon:" + ctx.anon
+}
+
+func rpcRetryError(code int, message string, wait time.Duration) error {
+	err := jsonrpc2.NewError(code, message)
+	err.Data = math.Ceil(wait.Seconds())
+	return err
+}
+
+// Whether forgetting the limiter would change nothing: the mute is over, the bucket has
+// refilled (so the next message resets the strikes), and the last message is too old
+// for slow mode or the repeat check.
+func (l *chatLimiter) expired(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	burst, rate := float64(chatBurst), chatRate
+	if l.bot {
+		burst, rate = chatBotBurst, chatBotRate
+	}
+	return now.After(l.muted) && now.Sub(l.updated).Seconds()*rate >= burst &&
+		now.Sub(l.sent) > chatMaxSlowMode*time.Second && now.Sub(l.sent) > chatRepeatWindow
+}
+
+// Check whether a message can be sent now, and if so, count it. `slow` is
+// the minimum interval between messages (0 if slow mode is off).
+func (l *chatLimiter) allow(text string, slow time.Duration) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Before(l.muted) {
+		return rpcRetryError(rpcErrMuted, "you are muted for flooding the chat", l.muted.Sub(now))
+	}
+	if wait := l.sent.Add(slow).Sub(now); slow > 0 && wait > 0 {
+		return rpcRetryError(rpcErrSlowMode, "slow mode is on", wait)
+	}
+	if text == l.text && now.Sub(l.sent) < chatRepeatWindow {
+		return jsonrpc2.NewError(rpcErrRepeated, "you have just sent the same message")
+	}
+	burst, rate := float64(chatBurst), chatRate
+	if l.bot {
+		burst, rate = chatBotBurst, chatBotRate
+	}
+	l.tokens = math.Min(burst, l.tokens+now.Sub(l.updated).Seconds()*rate)
+	l.updated = now
+	if l.tokens < 1 {
+		if l.strikes++; l.strikes >= chatStrikes {
+			l.strikes = 0
+			l.muted = now.Add(chatMuteDuration)
+			return rpcRetryError(rpcErrMuted, "you are muted for flooding the chat", chatMuteDuration)
+		}
+		wait := time.Duration((1 - l.tokens) / rate * float64(time.Second))
+		return rpcRetryError(rpcErrRateLimited, "you are sending messages too fast", wait)
+	}
+	l.tokens--
+	l.strikes = 0
+	l.text = text
+	l.sent = now
+	return nil
+}
+
+func (c *Chat) SlowMode() time.Duration {
+	return time.Duration(atomic.LoadInt32(&c.slow)) * time.Second
+}
+
+// (owner only) Allow each user to send at most one message per this many seconds.
+// Moderators are exempt. 0 turns slow mode off.
+func (ctx *chatter) SetSlowMode(args *RPCSingleIntArg, _ *interface{}) error {
+	return ctx.setSlowMode(args.First)
+}
+
+func (ctx *chatter) setSlowMode(seconds int) error {
+	if seconds < 0 || seconds > chatMaxSlowMode {
+		return errors.New("the interval must be between 0 and 3600 seconds")
+	}
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can change slow mode")); err != nil {
+		return err
+	}
+	if err := ctx.chat.db.SetChatSlowMode(ctx.chat.stream, seconds); err != nil {
+		return err
+	}
+	return ctx.chat.broadcast(chatSlowMode(seconds), "Relay.SlowMode", seconds)
+}
+
+func (ctx *chatter) pushSlowMode() error {
+	return RPCPushEvent(ctx.socket, "Chat.SlowMode", atomic.LoadInt32(&ctx.chat.slow))
+}
+
+func (ctx chatRelay) SlowMode(args *RPCSingleIntArg, _ *interface{}) error {
+	ctx.chat.post(chatSlowMode(args.First))
+	return nil
+}
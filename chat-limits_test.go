@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testLimitCode(t *testing.T, err error, code int) {
+	if code == 0 {
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		return
+	}
+	if e, ok := err.(*jsonrpc2.Error); !ok || e.Code != code {
+		t.Fatalf("expected error %d, got %v", code, err)
+	}
+}
+
+func TestChatLimiterBurst(t *testing.T) {
+	l := chatLimiter{}
+	for i := 0; i < chatBurst; i++ {
+		testLimitCode(t, l.allow("message "+strconv.Itoa(i), 0), 0)
+	}
+	testLimitCode(t, l.allow("one too many", 0), rpcErrRateLimited)
+	// Waiting for a second is enough for one more.
+	l.updated = l.updated.Add(-time.Second)
+	testLimitCode(t, l.allow("one more", 0), 0)
+}
+
+func TestChatLimiterBot(t *testing.T) {
+	l := chatLimiter{bot: true}
+	for i := 0; i < chatBotBurst; i++ {
+		testLimitCode(t, l.allow("message "+strconv.Itoa(i), 0), 0)
+	}
+	testLimitCode(t, l.allow("one too many", 0), rpcErrRateLimited)
+}
+
+func TestChatLimiterMute(t *testing.T) {
+	l := chatLimiter{}
+	for i := 0; i < chatBurst; i++ {
+		testLimitCode(t, l.allow("message "+strconv.Itoa(i), 0), 0)
+	}
+	for i := 1; i < chatStrikes; i++ {
+		testLimitCode(t, l.allow("flood", 0), rpcErrRateLimited)
+	}
+	testLimitCode(t, l.allow("flood", 0), rpcErrMuted)
+	l.updated = l.updated.Add(-time.Hour)
+	testLimitCode(t, l.allow("flood", 0), rpcErrMuted)
+	l.muted = time.Now()
+	testLimitCode(t, l.allow("flood", 0), 0)
+}
+
+func TestChatLimiterRepeat(t *testing.T) {
+	l := chatLimiter{}
+	testLimitCode(t, l.allow("hello", 0), 0)
+	testLimitCode(t, l.allow("hello", 0), rpcErrRepeated)
+	testLimitCode(t, l.allow("hello again", 0), 0)
+	l.sent = l.sent.Add(-chatRepeatWindow)
+	testLimitCode(t, l.allow("hello again", 0), 0)
+}
+
+func TestChatLimiterSlowMode(t *testing.T) {
+	l := chatLimiter{}
+	testLimitCode(t, l.allow("first", 10*time.Second), 0)
+	err := l.allow("second", 10*time.Second)
+	testLimitCode(t, err, rpcErrSlowMode)
+	if wait := err.(*jsonrpc2.Error).Data; wait != 10.0 {
+		t.Fatalf("expected to wait for 10 seconds, got %v", wait)
+	}
+	l.sent = l.sent.Add(-10 * time.Second)
+	testLimitCode(t, l.allow("second", 10*time.Second), 0)
+}
+
+func TestChatLimiterShared(t *testing.T) {
+	chat := NewChat(20)
+	defer chat.Close()
+	// Reconnecting, or opening another tab, does not reset the limits.
+	first := &chatter{chat: chat, login: "bob"}
+	for i := 0; i < chatBurst; i++ {
+		testLimitCode(t, first.limits().allow("message "+strconv.Itoa(i), 0), 0)
+	}
+	second := &chatter{chat: chat, login: "bob", anon: "another-session"}
+	testLimitCode(t, second.limits().allow("one too many", 0), rpcErrRateLimited)
+	// Bots of the same user are limited separately.
+	bot := &chatter{chat: chat, login: "bob", bot: true}
+	testLimitCode(t, bot.limits().allow("beep", 0), 0)
+	if a, b := (&chatter{chat: chat, anon: "x"}).limitKey(), (&chatter{chat: chat, anon: "y"}).limitKey(); a == b {
+		t.Fatalf("different sessions have the same limits: %q", a)
+	}
+}
+
+func TestChatLimiterExpired(t *testing.T) {
+	l := chatLimiter{}
+	testLimitCode(t, l.allow("hello", 0), 0)
+	if now := time.Now(); l.expired(now) {
+		t.Fatal("forgot a limiter that was just used")
+	}
+	if later := time.Now().Add(2 * chatMaxSlowMode * time.Second); !l.expired(later) {
+		t.Fatal("kept a limiter that has been idle for hours")
+	}
+	l.muted = time.Now().Add(24 * time.Hour)
+	if later := time.Now().Add(2 * chatMaxSlowMode * time.Second); l.expired(later) {
+		t.Fatal("forgot a mute")
+	}
+}
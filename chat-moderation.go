@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Sent when the owner appoints or removes a moderator.
+type chatRole struct {
+	login string
+	role  ChatRole
+}
+
+// Who to ban: a login, an anonymous session (the last parameter of `Chat.Message`),
+// or both. Timeouts also have a duration in seconds.
+type RPCChatTargetArg struct {
+	Login   string
+	Anon    string
+	Seconds int
+}
+
+func (x *RPCChatTargetArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Login, &x.Anon, &x.Seconds}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 2 && len(fields) != 3 {
+		return errors.New("invalid number of arguments")
+	}
+	if x.Login == "" && x.Anon == "" {
+		return errors.New("must specify a login or a session")
+	}
+	return nil
+}
+
+// The parameters of `Relay.Role`, and of `Relay.RoleChanged` sent back to relays.
+type RPCChatRoleArg struct {
+	Login string
+	Role  ChatRole
+}
+
+func (x *RPCChatRoleArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Login, &x.Role}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// Sent when a moderator bans someone or times them out.
+type chatBan RPCChatBanArg
+
+// The parameters of `Relay.Ban`, and of `Relay.Banned` sent back to relays. `Seconds`
+// is 0 for a ban; `By` is the name of the moderator.
+type RPCChatBanArg struct {
+	Login   string
+	Anon    string
+	Seconds int
+	By      string
+}
+
+func (x *RPCChatBanArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Login, &x.Anon, &x.Seconds, &x.By}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+var errNotModerator = errors.New("only moderators can do that")
+
+// Refuse to accept messages from banned users.
+func (c *Chat) checkBan(login string, anon string) error {
+	if c.db == nil {
+		return nil
+	}
+	banned, until, err := c.db.GetChatBan(c.stream, login, anon)
+	if err != nil || !banned {
+		return err
+	}
+	if until.IsZero() {
+		return errors.New("you are banned from this chat")
+	}
+	return fmt.Errorf("you are timed out for %v", time.Until(until).Round(time.Second))
+}
+
+func (ctx *chatter) role() ChatRole {
+	return ChatRole(atomic.LoadInt32(&ctx.rank))
+}
+
+// Ask the database what a logged in user may do. If it can't tell, they are a normal user.
+func (ctx *chatter) loadRole() {
+	if ctx.login == "" || ctx.chat.db == nil {
+		return
+	}
+	role, err := ctx.chat.db.GetChatRole(ctx.chat.stream, ctx.login)
+	if err != nil {
+		log.Println("Error loading a chat role: ", err)
+		return
+	}
+	atomic.StoreInt32(&ctx.rank, int32(role))
+}
+
+func (ctx *chatter) requireRole(min ChatRole, denied error) error {
+	if ctx.role() < min {
+		return denied
+	}
+	return nil
+}
+
+// Moderators can't ban each other, or the owner. Logged in users also have anonymous
+// sessions, and banning one of those would lock them out just the same.
+func (ctx *chatter) checkTarget(login string, anon string) error {
+	role := ctx.role()
+	if role < ChatModerator {
+		return errNotModerator
+	}
+	if login != "" {
+		target, err := ctx.chat.db.GetChatRole(ctx.chat.stream, login)
+		if err != nil {
+			return err
+		}
+		if target >= role {
+			return errors.New("cannot ban this user")
+		}
+	}
+	if anon != "" {
+		target, err := ctx.chat.db.GetChatAnonRole(ctx.chat.stream, anon)
+		if err != nil {
+			return err
+		}
+		if target >= role {
+			return errors.New("cannot ban this user")
+		}
+	}
+	return nil
+}
+
+func (ctx *chatter) AddModerator(args *RPCSingleStringArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can appoint moderators")); err != nil {
+		return err
+	}
+	err := ctx.chat.db.AddChatModerator(ctx.chat.stream, args.First)
+	if err == ErrUserNotExist {
+		return errors.New("no such user")
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.chat.broadcast(chatRole{args.First, ChatModerator}, "Relay.Role", args.First, ChatModerator)
+}
+
+func (ctx *chatter) RemoveModerator(args *RPCSingleStringArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatOwner, errors.New("only the owner can remove moderators")); err != nil {
+		return err
+	}
+	if err := ctx.chat.db.DelChatModerator(ctx.chat.stream, args.First); err != nil {
+		return err
+	}
+	return ctx.chat.broadcast(chatRole{args.First, ChatUser}, "Relay.Role", args.First, ChatUser)
+}
+
+func (ctx chatRelay) Role(args *RPCChatRoleArg, _ *interface{}) error {
+	ctx.chat.post(chatRole{args.Login, args.Role})
+	return nil
+}
+
+func (ctx *chatter) Ban(args *RPCChatTargetArg, _ *interface{}) error {
+	return ctx.ban(args.Login, args.Anon, 0)
+}
+
+func (ctx *chatter) Timeout(args *RPCChatTargetArg, _ *interface{}) error {
+	if args.Seconds <= 0 {
+		return errors.New("the timeout must be positive")
+	}
+	return ctx.ban(args.Login, args.Anon, args.Seconds)
+}
+
+func (ctx *chatter) ban(login string, anon string, seconds int) error {
+	if err := ctx.checkTarget(login, anon); err != nil {
+		return err
+	}
+	if err := ctx.chat.db.AddChatBan(ctx.chat.stream, login, anon, seconds); err != nil {
+		return err
+	}
+	event := chatBan{login, anon, seconds, ctx.name}
+	return ctx.chat.broadcast(event, "Relay.Ban", event.params()...)
+}
+
+// Relays check the role of whoever bans someone themselves.
+func (ctx chatRelay) Ban(args *RPCChatBanArg, _ *interface{}) error {
+	ctx.chat.post(chatBan(*args))
+	return nil
+}
+
+func (event chatBan) params() []interface{} {
+	return []interface{}{event.Login, event.Anon, event.Seconds, event.By}
+}
+
+func (event chatBan) to(u *chatter) bool {
+	return (event.Login != "" && u.login == event.Login) || (event.Anon != "" && u.anon == event.Anon)
+}
+
+func (ctx *chatter) Unban(args *RPCChatTargetArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatModerator, errNotModerator); err != nil {
+		return err
+	}
+	return ctx.chat.db.DelChatBan(ctx.chat.stream, args.Login, args.Anon)
+}
+
+func (ctx *chatter) DeleteMessage(args *RPCSingleIntArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatModerator, errNotModerator); err != nil {
+		return err
+	}
+	if err := ctx.chat.db.DelChatMessage(ctx.chat.stream, int64(args.First)); err != nil {
+		return err
+	}
+	return ctx.chat.broadcast(chatDeleted(args.First), "Relay.Delete", args.First)
+}
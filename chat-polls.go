@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	chatPollMaxOptions  = 10
+	chatPollMinDuration = 10
+	chatPollMaxDuration = 3600
+)
+
+// Sent when a poll is opened, closed, or voted in. Votes are counted by the database,
+// so the owner's chat reloads the poll (see `pollChanged`); relays then receive it
+// with `Chat.PollUpdate`, same as users.
+type chatPoll struct {
+	poll *StreamPoll
+}
+
+type RPCPollArg struct {
+	Question string
+	Options  []string
+	Seconds  int
+}
+
+func (x *RPCPollArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Question, &x.Options, &x.Seconds}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+type RPCVoteArg struct {
+	ID     int64
+	Option int
+}
+
+func (x *RPCVoteArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.ID, &x.Option}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// The parameters of `Chat.PollUpdate`.
+type RPCPollUpdateArg struct {
+	ID       int64
+	Question string
+	Options  []string
+	Votes    []int
+	Ends     time.Time
+	Open     bool
+}
+
+func (x *RPCPollUpdateArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.ID, &x.Question, &x.Options, &x.Votes, &x.Ends, &x.Open}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect || len(x.Options) != len(x.Votes) {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+func (x *RPCPollUpdateArg) poll() *StreamPoll {
+	poll := &StreamPoll{ID: x.ID, Question: x.Question, Ends: x.Ends, Open: x.Open}
+	for i, text := range x.Options {
+		poll.Options = append(poll.Options, StreamPollOption{text, x.Votes[i]})
+	}
+	return poll
+}
+
+// (moderators only) Ask everyone a question. Only one poll can be open at a time.
+func (ctx *chatter) StartPoll(args *RPCPollArg, _ *interface{}) error {
+	if err := ctx.requireRole(ChatModerator, errNotModerator); err != nil {
+		return err
+	}
+	return ctx.startPoll(args.Question, args.Options, args.Seconds)
+}
+
+func (ctx *chatter) startPoll(question string, options []string, seconds int) error {
+	question = strings.TrimSpace(question)
+	if len(question) == 0 || len(question) > 256 {
+		return errors.New("the question must have between 1 and 256 characters")
+	}
+	if len(options) < 2 || len(options) > chatPollMaxOptions {
+		return errors.New("a poll must have between 2 and 10 options")
+	}
+	clean := make([]string, len(options))
+	for i, option := range options {
+		// Options are saved one per line, so no line breaks.
+		if clean[i] = strings.Join(strings.Fields(option), " "); len(clean[i]) == 0 || len(clean[i]) > 100 {
+			return errors.New("options must have between 1 and 100 characters")
+		}
+	}
+	if seconds < chatPollMinDuration || seconds > chatPollMaxDuration {
+		return errors.New("a poll must last between 10 and 3600 seconds")
+	}
+	pollid, err := ctx.chat.db.AddChatPoll(ctx.chat.stream, question, clean, seconds)
+	if err != nil {
+		return err
+	}
+	return ctx.chat.pollChanged(pollid)
+}
+
+// (moderators only) Close the current poll before it runs out of time.
+func (ctx *chatter) EndPoll(_ *interface{}, _ *interface{}) error {
+	if err := ctx.requireRole(ChatModerator, errNotModerator); err != nil {
+		return err
+	}
+	return ctx.endPoll()
+}
+
+func (ctx *chatter) endPoll() error {
+	if err := ctx.chat.db.EndChatPoll(ctx.chat.stream); err != nil {
+		return err
+	}
+	return ctx.chat.pollChanged(0)
+}
+
+func (ctx *chatter) Vote(args *RPCVoteArg, _ *interface{}) error {
+	if ctx.chat.db == nil {
+		return ErrNotSupported
+	}
+	if ctx.login == "" && ctx.transient {
+		// Reconnecting would be enough to vote again.
+		return errors.New("must be logged in or accept cookies to vote")
+	}
+	if err := ctx.chat.checkBan(ctx.login, ctx.anon); err != nil {
+		return err
+	}
+	poll, err := ctx.chat.db.GetChatPoll(ctx.chat.stream)
+	if err != nil {
+		return err
+	}
+	if poll.ID != args.ID || !poll.Open {
+		return errors.New("this poll is closed")
+	}
+	if args.Option < 0 || args.Option >= len(poll.Options) {
+		return errors.New("no such option")
+	}
+	if err := ctx.chat.db.AddChatVote(poll.ID, args.Option, ctx.login, ctx.anon); err != nil {
+		return err
+	}
+	return ctx.chat.pollChanged(poll.ID)
+}
+
+// Show everyone the current state of the poll. Relays ask the owner to do it.
+func (c *Chat) pollChanged(id int64) error {
+	if c.upstream != nil {
+		return c.callUpstream("Relay.Poll", id)
+	}
+	c.loadPoll()
+	return nil
+}
+
+// Read the latest poll from the database and pass it to `handle`.
+func (c *Chat) loadPoll() {
+	if c.db == nil {
+		return
+	}
+	poll, err := c.db.GetChatPoll(c.stream)
+	if err != nil {
+		if err != ErrPollNotExist {
+			log.Println("Error loading a poll: ", err)
+		}
+		return
+	}
+	c.post(chatPoll{poll})
+}
+
+// Whether a poll has anything new to show. Only called by `handle`.
+func (c *Chat) showPoll(poll *StreamPoll) bool {
+	if c.poll != nil && c.poll.ID == poll.ID && !c.poll.Open {
+		return false // The final result has already been sent.
+	}
+	if c.upstream == nil && poll.Open && (c.poll == nil || c.poll.ID != poll.ID) {
+		// Nobody votes when the poll ends, so something has to reload it to send
+		// the result. The database stores whole seconds, hence the extra one.
+		time.AfterFunc(time.Until(poll.Ends)+time.Second, c.loadPoll)
+	}
+	return true
+}
+
+func (ctx *chatter) pushPoll(poll *StreamPoll) error {
+	options := make([]string, len(poll.Options))
+	votes := make([]int, len(poll.Options))
+	for i, option := range poll.Options {
+		options[i], votes[i] = option.Text, option.Votes
+	}
+	return RPCPushEvent(ctx.socket, "Chat.PollUpdate", poll.ID, poll.Question, options, votes, poll.Ends, poll.Open)
+}
+
+// Relays count votes in the database themselves.
+func (ctx chatRelay) Poll(args *RPCSingleIntArg, _ *interface{}) error {
+	return ctx.chat.pollChanged(int64(args.First))
+}
+
+func (ctx *chatter) commandPoll(args string) error {
+	duration, rest := splitCommand(args)
+	seconds, err := strconv.Atoi(duration)
+	parts := strings.Split(rest, "|")
+	if err != nil || len(parts) < 3 {
+		return errUsage(chatCommands["poll"])
+	}
+	return ctx.startPoll(parts[0], parts[1:], seconds)
+}
+
+func (ctx *chatter) commandEndPoll(args string) error {
+	return ctx.endPoll()
+}
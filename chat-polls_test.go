@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChatPollTally(t *testing.T) {
+	db, err := NewSQLDatabase("", "sqlite3", t.TempDir()+"/polls.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.NewUser("pollster", "pollster@example.com", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.AddChatPoll("pollster", "Which one?", []string{"this", "that", "neither"}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddChatPoll("pollster", "Another?", []string{"yes", "no"}, 60); err == nil {
+		t.Fatal("opened a second poll while the first is open")
+	}
+	for _, v := range []struct {
+		option      int
+		login, anon string
+		err         error
+	}{
+		{0, "alice", "", nil},
+		{1, "alice", "", ErrAlreadyVoted},
+		{1, "bob", "x", nil},
+		{1, "", "x", nil}, // Logged in and anonymous votes are counted separately.
+		{2, "", "x", ErrAlreadyVoted},
+		{1, "", "y", nil},
+	} {
+		if err := db.AddChatVote(id, v.option, v.login, v.anon); err != v.err {
+			t.Fatalf("%d from %q/%q: expected %v, got %v", v.option, v.login, v.anon, v.err, err)
+		}
+	}
+	poll, err := db.GetChatPoll("pollster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poll.ID != id || !poll.Open || poll.Question != "Which one?" || len(poll.Options) != 3 {
+		t.Fatalf("unexpected poll: %+v", poll)
+	}
+	for i, votes := range []int{1, 3, 0} {
+		if poll.Options[i].Votes != votes {
+			t.Errorf("%q: expected %d votes, got %d", poll.Options[i].Text, votes, poll.Options[i].Votes)
+		}
+	}
+	if err := db.EndChatPoll("pollster"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddChatVote(id, 0, "carol", ""); err != ErrAlreadyVoted {
+		t.Fatalf("voted in a closed poll: %v", err)
+	}
+	if poll, err = db.GetChatPoll("pollster"); err != nil || poll.Open || poll.Options[1].Votes != 3 {
+		t.Fatalf("unexpected poll after closing: %+v, %v", poll, err)
+	}
+}
+
+func TestChatPollTransientVote(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/transient.db")
+	testSQLStreamer(t, db, "alice")
+	id, err := db.AddChatPoll("alice", "Which one?", []string{"this", "that"}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(20)
+	defer chat.Close()
+	chat.db = db
+	chat.stream = "alice"
+	// A session that is not kept in a cookie could vote again by reconnecting.
+	transient := &chatter{chat: chat, anon: "x", transient: true}
+	if err := transient.Vote(&RPCVoteArg{id, 0}, nil); err == nil {
+		t.Fatal("voted without a persistent session")
+	}
+	logged := &chatter{chat: chat, login: "bob", anon: "y", transient: true}
+	if err := logged.Vote(&RPCVoteArg{id, 0}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
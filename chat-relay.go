@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"golang.org/x/net/websocket"
+	"net/rpc"
+	"time"
+)
+
+// Sent by a relay when the number of its chat users changes.
+type chatRelayUsers struct {
+	relay *chatter
+	users int
+}
+
+// The methods of `Relay`, available to other nodes (see `Context.IsRelay`).
+type chatRelay struct {
+	*chatter
+}
+
+// The parameters of `Chat.Message`. Relays send messages with a zero ID and
+// timestamp, as those are assigned by the owning node.
+type RPCChatMessageArg struct {
+	Name  string
+	Text  string
+	Login string
+	ID    int64
+	Time  time.Time
+	Anon  string
+	Bot   bool
+}
+
+func (x *RPCChatMessageArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Name, &x.Text, &x.Login, &x.ID, &x.Time, &x.Anon, &x.Bot}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+type RPCSingleIntArg struct {
+	First int
+}
+
+func (x *RPCSingleIntArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.First}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// Create a chat that sends messages to the one at the other end of `upstream`.
+// Its notifications are repeated to local users by `receive`.
+func NewRelayChat(qsize int, upstream *websocket.Conn) *Chat {
+	c := NewChat(qsize)
+	c.upstream = upstream
+	return c
+}
+
+func (c *Chat) userCount() int {
+	n := 0
+	for u := range c.Users {
+		if u.relay {
+			n += u.users
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Chat) callUpstream(method string, params ...interface{}) error {
+	// No ID means no response, which would only be ignored anyway.
+	return websocket.JSON.Send(c.upstream, map[string]interface{}{
+		"jsonrpc": "2.0", "method": method, "params": params,
+	})
+}
+
+// Repeat notifications from the upstream chat to local users until it disconnects.
+// Returns true if it has moved to another node instead; see `Chat.Move`.
+func (c *Chat) receive() bool {
+	for {
+		var msg struct {
+			Method string
+			Params []json.RawMessage
+		}
+		if err := websocket.JSON.Receive(c.upstream, &msg); err != nil {
+			return false
+		}
+		switch msg.Method {
+		case "", "RPC.Loaded":
+		case "RPC.Redirect":
+			return true
+		case "Chat.Message", "Chat.Action":
+			event := RPCChatMessageArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(ChatMessage{
+					name: event.Name, login: event.Login, text: event.Text, id: event.ID,
+					time: event.Time, anon: event.Anon, action: msg.Method == "Chat.Action", bot: event.Bot,
+				})
+			}
+		case "Chat.Whisper":
+			event := RPCWhisperArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatWhisper(event))
+			}
+		case "Chat.PollUpdate":
+			event := RPCPollUpdateArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatPoll{event.poll()})
+			}
+		case "Relay.FiltersChanged":
+			c.loadFilters()
+		case "Relay.RoleChanged":
+			event := RPCChatRoleArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatRole{event.Login, event.Role})
+			}
+		case "Relay.Banned":
+			event := RPCChatBanArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatBan(event))
+			}
+		case "Chat.MessageHeld", "Chat.HeldResolved":
+			params := make([]interface{}, len(msg.Params))
+			for i, p := range msg.Params {
+				params[i] = p
+			}
+			c.post(chatModNotification{msg.Method, params})
+		case "Chat.Clear":
+			event := RPCSingleStringArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatClear(event.First))
+			}
+		case "Chat.SlowMode":
+			event := RPCSingleIntArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatSlowMode(event.First))
+			}
+		case "Chat.MessageDeleted":
+			event := RPCSingleIntArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatDeleted(event.First))
+			}
+		case "Stream.Online", "Stream.Offline":
+			c.post(chatOnline{online: msg.Method == "Stream.Online"})
+		case "Stream.ViewerCount":
+			event := RPCSingleIntArg{}
+			if buf, err := json.Marshal(msg.Params); err == nil && json.Unmarshal(buf, &event) == nil {
+				c.post(chatViewerCount(event.First))
+			}
+		default:
+			params := make([]interface{}, len(msg.Params))
+			for i, p := range msg.Params {
+				params[i] = p
+			}
+			c.post(chatNotification{msg.Method, params})
+		}
+	}
+}
+
+// Serve a connection from a node that relays this chat. It receives the same
+// notifications as everyone else, including the history. Returns false if the chat
+// was closed before the connection could join it, same as `RunRPC`.
+func (chat *Chat) RunRelay(ws *websocket.Conn) bool {
+	chatter := &chatter{socket: ws, chat: chat, relay: true}
+	if !chat.post(chatter) {
+		return false
+	}
+	defer chat.Disconnect(chatter)
+	chat.History.Iterate(chatter.pushMessage)
+	server := rpc.NewServer()
+	server.RegisterName("Relay", chatRelay{chatter})
+	server.ServeCodec(jsonrpc2.NewServerCodec(ws, server))
+	return true
+}
+
+func (ctx chatRelay) Message(args *RPCChatMessageArg, _ *interface{}) error {
+	return ctx.message(args, false)
+}
+
+func (ctx chatRelay) Action(args *RPCChatMessageArg, _ *interface{}) error {
+	return ctx.message(args, true)
+}
+
+func (ctx chatRelay) message(args *RPCChatMessageArg, action bool) error {
+	if len(args.Text) == 0 || len(args.Text) > 256 {
+		return errors.New("message must have between 1 and 256 characters")
+	}
+	if err := ctx.chat.checkBan(args.Login, args.Anon); err != nil {
+		return err
+	}
+	ctx.chat.postMessage(ChatMessage{name: args.Name, login: args.Login, text: args.Text, anon: args.Anon, action: action, bot: args.Bot})
+	return nil
+}
+
+func (ctx chatRelay) Whisper(args *RPCWhisperArg, _ *interface{}) error {
+	ctx.chat.post(chatWhisper(*args))
+	return nil
+}
+
+func (ctx chatRelay) Notice(args *RPCSingleStringArg, _ *interface{}) error {
+	ctx.chat.Notify("Chat.Notice", args.First)
+	return nil
+}
+
+func (ctx chatRelay) Clear(args *RPCSingleStringArg, _ *interface{}) error {
+	ctx.chat.post(chatClear(args.First))
+	return nil
+}
+
+// Relays check the role of whoever deletes a message themselves.
+func (ctx chatRelay) Delete(args *RPCSingleIntArg, _ *interface{}) error {
+	ctx.chat.post(chatDeleted(args.First))
+	return nil
+}
+
+func (ctx chatRelay) Users(args *RPCSingleIntArg, _ *interface{}) error {
+	ctx.chat.post(chatRelayUsers{ctx.chatter, args.First})
+	return nil
+}
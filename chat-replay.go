@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"golang.org/x/net/websocket"
+	"net/rpc"
+	"sort"
+	"sync"
+)
+
+// How many messages to show right after seeking, as if they were the history.
+const replayBacklog = 20
+
+// Chat messages of a recorded broadcast, pushed to a client as the playback
+// reaches the points at which they were originally sent.
+type chatReplay struct {
+	socket   *websocket.Conn
+	messages []StreamChatMessage
+	offsets  []float64 // Seconds since the start of the recording.
+	// Calls are handled concurrently, but the client expects messages in order.
+	lock sync.Mutex
+	next int
+}
+
+type RPCSingleFloatArg struct {
+	First float64
+}
+
+func (x *RPCSingleFloatArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.First}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// Serve JSON-RPC requests from the player of a recording until the connection is closed.
+func RunReplay(ws *websocket.Conn, rec *StreamRecording, messages []StreamChatMessage) {
+	ctx := &chatReplay{socket: ws, messages: messages, offsets: make([]float64, len(messages))}
+	for i, msg := range messages {
+		ctx.offsets[i] = msg.Timestamp.Sub(rec.Timestamp).Seconds()
+	}
+	RPCPushEvent(ws, "RPC.Loaded", true)
+	server := rpc.NewServer()
+	server.RegisterName("Replay", ctx)
+	server.ServeCodec(jsonrpc2.NewServerCodec(ws, server))
+}
+
+// The index of the first message sent after `position`.
+func (ctx *chatReplay) find(position float64) int {
+	return sort.Search(len(ctx.offsets), func(i int) bool { return ctx.offsets[i] > position })
+}
+
+func (ctx *chatReplay) push(from int, to int) error {
+	for _, msg := range ctx.messages[from:to] {
+		m := chatMessageFrom(msg)
+		m.anon = "" // (nobody moderates recordings; see `chatter.messageParams`)
+		if err := RPCPushEvent(ctx.socket, m.method(), m.params()...); err != nil {
+			return err
+		}
+	}
+	ctx.next = to
+	return nil
+}
+
+// Start over at a new position. The client should clear the chat log first.
+func (ctx *chatReplay) Seek(args *RPCSingleFloatArg, _ *interface{}) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	to := ctx.find(args.First)
+	from := to - replayBacklog
+	if from < 0 {
+		from = 0
+	}
+	return ctx.push(from, to)
+}
+
+// Send the messages between the previous position and this one.
+func (ctx *chatReplay) Sync(args *RPCSingleFloatArg, _ *interface{}) error {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	if to := ctx.find(args.First); to > ctx.next {
+		return ctx.push(ctx.next, to)
+	}
+	return nil
+}
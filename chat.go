@@ -5,22 +5,80 @@ import (
 	"errors"
 	"github.com/powerman/rpc-codec/jsonrpc2"
 	"golang.org/x/net/websocket"
+	"log"
 	"net/rpc"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Chat struct {
 	events  chan interface{}
 	Users   map[*chatter]struct{}
 	History ChatMessageQueue
+	// The number of people watching the stream on all nodes, see `SetViewerCount`.
+	viewers int
+	// If set, this chat relays the one on the node that owns the stream.
+	upstream *websocket.Conn
+	// Whether the stream is being broadcast; see `SetOnline`.
+	online bool
+	// `len(Users)`, but safe to read from other goroutines.
+	size int32
+	// Seconds between messages from the same user, see `SetSlowMode`. Also atomic.
+	slow int32
+	// Where to save messages so that they can be replayed along with recordings
+	// of the session they were sent during. Relays leave this to the owner, but
+	// still read the history from here. Messages are saved by whoever sends them
+	// rather than by `handle`, so `session` is atomic.
+	db      Database
+	stream  string
+	session int64
+	// The latest poll, see `chat-polls.go`.
+	poll *StreamPoll
+	// A `*chatFilterSet`, see `chat-filters.go`.
+	filters atomic.Value
+	// Rate limits by `chatter.limitKey`, so that reconnecting does not reset them;
+	// see `chat-limits.go`. Relays keep their own for their users.
+	limitLock sync.Mutex
+	limiters  map[string]*chatLimiter
+	// Closed once `handle` stops reading events.
+	done chan struct{}
+}
+
+type chatViewerCount int
+
+type chatOnline struct {
+	online  bool
+	session int64
+}
+
+// A notification for every connected user.
+type chatNotification struct {
+	method string
+	params []interface{}
 }
 
 type ChatMessage struct {
 	name  string
 	login string
 	text  string
+	id    int64
+	time  time.Time
+	anon  string
+	// Sent with `/me`; see `chat-commands.go`.
+	action bool
+	bot    bool
+	// Set by `ChatMessageQueue.Remove` and `Clear`.
+	deleted bool
 }
 
+// Sent when a moderator deletes a message with a given ID.
+type chatDeleted int64
+
+// Sent when the room has moved to another node; see `Move`.
+type chatMoved string
+
 type ChatMessageQueue struct {
 	data  []ChatMessage
 	start int
@@ -29,8 +87,22 @@ type ChatMessageQueue struct {
 type chatter struct {
 	name   string
 	login  string
+	anon   string
+	bot    bool // Connected with an API token; see `Context.GetChatAuthInfo`.
 	socket *websocket.Conn
 	chat   *Chat
+	// Set if `anon` is not stored in a cookie, so a new connection would get another.
+	transient bool
+	// Set for connections from other nodes, which stand for `users` people each.
+	relay bool
+	users int
+	// The name is reserved in the database (see `Database.ClaimChatName`) while
+	// the chatter is connected.
+	nameLock sync.Mutex
+	claim    int64
+	// The `ChatRole` of `login`, loaded on connecting and kept up to date by `chatRole`
+	// so that `handle` does not have to ask the database. Atomic.
+	rank int32
 }
 
 func (q *ChatMessageQueue) Push(x ChatMessage) {
@@ -46,29 +118,51 @@ func (q *ChatMessageQueue) Iterate(f func(x ChatMessage) error) error {
 	// this should be safe to use without a mutex. at worst, pushing more than
 	// `cap(q.data)` messages while iterating may result in skipping over some of them.
 	for i, s, n := 0, q.start, len(q.data); i < n; i++ {
-		if err := f(q.data[(i+s)%n]); err != nil {
-			return err
+		if x := q.data[(i+s)%n]; !x.deleted {
+			if err := f(x); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
+func (q *ChatMessageQueue) Clear() {
+	for i := range q.data {
+		q.data[i].deleted = true
+	}
+}
+
+func (q *ChatMessageQueue) Remove(id int64) {
+	for i := range q.data {
+		if q.data[i].id == id {
+			q.data[i].deleted = true
+		}
+	}
+}
+
 func NewChat(qsize int) *Chat {
 	ctx := &Chat{
-		events:  make(chan interface{}),
-		Users:   make(map[*chatter]struct{}),
-		History: ChatMessageQueue{make([]ChatMessage, 0, qsize), 0},
+		events:   make(chan interface{}),
+		Users:    make(map[*chatter]struct{}),
+		History:  ChatMessageQueue{make([]ChatMessage, 0, qsize), 0},
+		done:     make(chan struct{}),
+		limiters: make(map[string]*chatLimiter),
 	}
 	go ctx.handle()
 	return ctx
 }
 
 func (c *Chat) handle() {
+	defer close(c.done)
 	closed := false
 	for genericEvent := range c.events {
 		switch event := genericEvent.(type) {
 		case nil:
 			closed = true
+			if c.upstream != nil {
+				c.upstream.Close()
+			}
 			for u := range c.Users {
 				u.socket.Close()
 			}
@@ -83,8 +177,28 @@ func (c *Chat) handle() {
 					return // if these events were left unhandled, senders would block forever
 				}
 			} else {
+				if closed {
+					event.socket.Close() // nobody else will
+				}
 				c.Users[event] = struct{}{}
+				event.pushOnline()
+				if c.slow != 0 {
+					event.pushSlowMode()
+				}
+				if c.poll != nil && c.poll.Open {
+					event.pushPoll(c.poll)
+				}
+			}
+			atomic.StoreInt32(&c.size, int32(len(c.Users)))
+			for u := range c.Users {
+				u.pushViewerCount()
+			}
+			if c.upstream != nil {
+				c.callUpstream("Relay.Users", len(c.Users))
 			}
+
+		case chatRelayUsers:
+			event.relay.users = event.users
 			for u := range c.Users {
 				u.pushViewerCount()
 			}
@@ -94,37 +208,206 @@ func (c *Chat) handle() {
 			for u := range c.Users {
 				u.pushMessage(event)
 			}
+
+		case chatSlowMode:
+			atomic.StoreInt32(&c.slow, int32(event))
+			for u := range c.Users {
+				u.pushSlowMode()
+			}
+
+		case chatWhisper:
+			for u := range c.Users {
+				if u.relay {
+					RPCPushEvent(u.socket, "Chat.Whisper", event.params(true)...)
+				} else if event.to(u) {
+					RPCPushEvent(u.socket, "Chat.Whisper", event.params(false)...)
+				}
+			}
+
+		case chatPoll:
+			if !c.showPoll(event.poll) {
+				break
+			}
+			c.poll = event.poll
+			for u := range c.Users {
+				u.pushPoll(c.poll)
+			}
+
+		case chatRole:
+			for u := range c.Users {
+				if u.relay {
+					RPCPushEvent(u.socket, "Relay.RoleChanged", event.login, event.role)
+				} else if u.login == event.login && u.role() != ChatOwner {
+					atomic.StoreInt32(&u.rank, int32(event.role))
+				}
+			}
+
+		case chatFilters:
+			for u := range c.Users {
+				if u.relay {
+					RPCPushEvent(u.socket, "Relay.FiltersChanged")
+				}
+			}
+
+		case chatModNotification:
+			for u := range c.Users {
+				if u.relay {
+					RPCPushEvent(u.socket, event.method, event.params...)
+				} else if u.role() >= ChatModerator {
+					RPCPushEvent(u.socket, event.method, event.params...)
+				}
+			}
+
+		case chatBan:
+			for u := range c.Users {
+				if u.relay {
+					RPCPushEvent(u.socket, "Relay.Banned", event.params()...)
+				} else if event.to(u) {
+					RPCPushEvent(u.socket, "Chat.Banned", event.Seconds)
+				} else if u.role() >= ChatModerator {
+					RPCPushEvent(u.socket, "Chat.UserBanned", event.params()...)
+				}
+			}
+
+		case chatClear:
+			c.History.Clear()
+			for u := range c.Users {
+				RPCPushEvent(u.socket, "Chat.Clear", string(event))
+			}
+
+		case chatDeleted:
+			c.History.Remove(int64(event))
+			for u := range c.Users {
+				RPCPushEvent(u.socket, "Chat.MessageDeleted", int64(event))
+			}
+
+		case chatViewerCount:
+			if c.viewers != int(event) {
+				c.viewers = int(event)
+				for u := range c.Users {
+					u.pushViewerCount()
+				}
+			}
+
+		case chatOnline:
+			atomic.StoreInt64(&c.session, event.session)
+			if c.online != event.online {
+				if c.online = event.online; !c.online {
+					c.viewers = 0
+				}
+				for u := range c.Users {
+					u.pushOnline()
+					u.pushViewerCount()
+				}
+			}
+
+		case chatNotification:
+			for u := range c.Users {
+				RPCPushEvent(u.socket, event.method, event.params...)
+			}
+
+		case chatMoved:
+			for u := range c.Users {
+				server := string(event)
+				if server == "" {
+					server = u.socket.Request().Host
+				}
+				RPCPushEvent(u.socket, "RPC.Redirect", "//"+server+u.socket.Request().URL.Path)
+			}
 		}
 	}
 }
 
-func (c *Chat) Connect(ws *websocket.Conn, auth *UserData) *chatter {
-	chatter := &chatter{socket: ws, chat: c}
+// Add a user to the chat. Returns nil if the chat has already been closed.
+// An empty `anon` means the connection has no session of its own, so it gets a new one.
+func (c *Chat) Connect(ws *websocket.Conn, auth *UserData, bot bool, anon string) *chatter {
+	chatter := &chatter{socket: ws, chat: c, anon: anon}
+	if anon == "" {
+		chatter.anon = makeToken(16)
+		chatter.transient = true
+	}
 	if auth != nil {
-		chatter.name = auth.Name
 		chatter.login = auth.Login
-		chatter.pushName()
+		chatter.bot = bot
+		chatter.loadRole()
+		// The display name may be taken by someone else, but the login can't be.
+		for _, name := range []string{auth.Name, auth.Login} {
+			if chatter.claimName(name) == nil {
+				chatter.pushName()
+				break
+			}
+		}
+	}
+	if !c.post(chatter) {
+		chatter.releaseName()
+		return nil
 	}
-	c.events <- chatter
 	return chatter
 }
 
 func (c *Chat) Disconnect(u *chatter) {
-	c.events <- u
+	c.post(u)
+}
+
+// Pass an event to `handle`. Returns false if the chat has been closed, in which
+// case there is no one to read it.
+func (c *Chat) post(event interface{}) bool {
+	select {
+	case c.events <- event:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Chat) Notify(method string, params ...interface{}) {
+	c.post(chatNotification{method, params})
+}
+
+func (c *Chat) SetViewerCount(n int) {
+	c.post(chatViewerCount(n))
+}
+
+// Tell everyone that the stream has started or ended. The chat stays open either way;
+// messages sent while the stream is online are attached to the broadcast `session`.
+func (c *Chat) SetOnline(online bool, session int64) {
+	c.post(chatOnline{online, session})
+}
+
+func (c *Chat) Idle() bool {
+	return atomic.LoadInt32(&c.size) == 0
+}
+
+// Send everyone to the room on `server`, or back through the node they have connected to
+// if empty (which will then relay them there). The room should be closed afterwards.
+func (c *Chat) Move(server string) {
+	c.post(chatMoved(server))
 }
 
 func (c *Chat) Close() {
-	c.events <- nil
+	c.post(nil)
 }
 
-func (chat *Chat) RunRPC(ws *websocket.Conn, user *UserData) {
-	chatter := chat.Connect(ws, user)
+// Serve JSON-RPC requests until the connection is closed. `stream` provides
+// the methods of `Stream`, if any. Bots are logged in with an API token. Returns false
+// if the chat was closed before the connection could join it; it can then join a new one.
+func (chat *Chat) RunRPC(ws *websocket.Conn, user *UserData, bot bool, anon string, stream interface{}) bool {
+	chatter := chat.Connect(ws, user, bot, anon)
+	if chatter == nil {
+		return false
+	}
 	defer chat.Disconnect(chatter)
+	defer chatter.releaseName()
 	RPCPushEvent(ws, "RPC.Loaded", true)
 	chat.History.Iterate(chatter.pushMessage)
+	chatter.pushHeld()
 	server := rpc.NewServer()
 	server.RegisterName("Chat", chatter)
+	if stream != nil {
+		server.RegisterName("Stream", stream)
+	}
 	server.ServeCodec(jsonrpc2.NewServerCodec(ws, server))
+	return true
 }
 
 type RPCSingleStringArg struct {
@@ -154,20 +437,157 @@ func (ctx *chatter) SetName(args *RPCSingleStringArg, _ *interface{}) error {
 	if err := ValidateUsername(name); err != nil {
 		return err
 	}
-	ctx.name = name
+	if err := ctx.claimName(name); err != nil {
+		return err
+	}
 	ctx.pushName()
 	return nil
 }
 
+// Take a name, giving up the previous one if successful.
+func (ctx *chatter) claimName(name string) error {
+	ctx.nameLock.Lock()
+	defer ctx.nameLock.Unlock()
+	if ctx.chat.db != nil {
+		claim, err := ctx.chat.db.ClaimChatName(ctx.chat.stream, name, ctx.login, ctx.anon)
+		if err == ErrUserNotUnique {
+			return errors.New("this name is already taken")
+		}
+		if err != nil {
+			return err
+		}
+		if ctx.claim != 0 {
+			ctx.chat.db.ReleaseChatName(ctx.claim)
+		}
+		ctx.claim = claim
+	}
+	ctx.name = name
+	return nil
+}
+
+func (ctx *chatter) releaseName() {
+	ctx.nameLock.Lock()
+	defer ctx.nameLock.Unlock()
+	if ctx.claim != 0 {
+		ctx.chat.db.ReleaseChatName(ctx.claim)
+		ctx.claim = 0
+	}
+}
+
 func (ctx *chatter) SendMessage(args *RPCSingleStringArg, _ *interface{}) error {
 	if ctx.name == "" {
 		return errors.New("must obtain a name first")
 	}
-	msg := ChatMessage{ctx.name, ctx.login, strings.TrimSpace(args.First)}
+	text := strings.TrimSpace(args.First)
+	if strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//") {
+		return ctx.runCommand(text[1:])
+	}
+	if strings.HasPrefix(text, "//") {
+		text = text[1:]
+	}
+	return ctx.send(ChatMessage{name: ctx.name, login: ctx.login, text: text, anon: ctx.anon, bot: ctx.bot})
+}
+
+// Check the message against the limits and filters, and send it to everyone.
+func (ctx *chatter) send(msg ChatMessage) error {
 	if len(msg.text) == 0 || len(msg.text) > 256 {
 		return errors.New("message must have between 1 and 256 characters")
 	}
-	ctx.chat.events <- msg
+	if err := ctx.chat.checkBan(msg.login, msg.anon); err != nil {
+		return err
+	}
+	role := ctx.role()
+	held := ""
+	// The owner is trusted to know what they are doing.
+	if filters := ctx.chat.Filters(); filters != nil && role < ChatOwner {
+		var err error
+		if msg.text, held, err = filters.apply(msg.text, role); err != nil {
+			return err
+		}
+	}
+	slow := ctx.chat.SlowMode()
+	if role >= ChatModerator {
+		slow = 0
+	}
+	if err := ctx.limits().allow(msg.text, slow); err != nil {
+		return err
+	}
+	if held != "" {
+		return ctx.hold(msg, held)
+	}
+	return ctx.chat.broadcastMessage(msg)
+}
+
+// Same as `broadcast`, but for messages, which the owner's chat also saves.
+func (c *Chat) broadcastMessage(msg ChatMessage) error {
+	if c.upstream != nil {
+		if msg.action {
+			return c.callUpstream("Relay.Action", msg.params()...)
+		}
+		return c.callUpstream("Relay.Message", msg.params()...)
+	}
+	c.postMessage(msg)
+	return nil
+}
+
+// Pass an event to `handle`, or if this is a relay, send it to the owning node,
+// which then passes the event to everyone, including this node.
+func (c *Chat) broadcast(event interface{}, relayMethod string, params ...interface{}) error {
+	if c.upstream != nil {
+		return c.callUpstream(relayMethod, params...)
+	}
+	c.post(event)
+	return nil
+}
+
+// Assign an ID and a timestamp to a message sent to the owner's chat, saving it
+// to be replayed with the recording of the current session, then pass it to `handle`.
+func (c *Chat) postMessage(msg ChatMessage) {
+	if c.db != nil {
+		var err error
+		if msg.id, err = c.db.AddChatMessage(c.stream, atomic.LoadInt64(&c.session), msg.stored()); err != nil {
+			log.Println("Error saving a chat message: ", err)
+		}
+	}
+	msg.time = time.Now().UTC()
+	c.post(msg)
+}
+
+type RPCHistoryArg struct {
+	Before int64
+	Limit  int
+}
+
+func (x *RPCHistoryArg) UnmarshalJSON(buf []byte) error {
+	fields := []interface{}{&x.Before, &x.Limit}
+	expect := len(fields)
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return err
+	}
+	if len(fields) != expect {
+		return errors.New("invalid number of arguments")
+	}
+	return nil
+}
+
+// Return up to `limit` messages sent before the one with the given ID (or the latest
+// ones, if the ID is 0), oldest first. Each is a list of `Chat.Message` parameters.
+func (ctx *chatter) RequestHistory(args *RPCHistoryArg, reply *[][]interface{}) error {
+	if args.Limit <= 0 || args.Limit > 100 {
+		return errors.New("limit must be between 1 and 100")
+	}
+	*reply = [][]interface{}{}
+	if ctx.chat.db == nil {
+		return nil
+	}
+	messages, err := ctx.chat.db.GetChatHistory(ctx.chat.stream, args.Before, args.Limit)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		m := chatMessageFrom(msg)
+		*reply = append(*reply, append([]interface{}{m.method()}, ctx.messageParams(m)...))
+	}
 	return nil
 }
 
@@ -175,10 +595,52 @@ func (ctx *chatter) pushName() error {
 	return RPCPushEvent(ctx.socket, "Chat.AcquiredName", ctx.name, ctx.login)
 }
 
+func chatMessageFrom(m StreamChatMessage) ChatMessage {
+	return ChatMessage{name: m.Name, login: m.Login, text: m.Text, id: m.ID, time: m.Timestamp, anon: m.Anon, action: m.Action, bot: m.Bot}
+}
+
+func (msg ChatMessage) stored() *StreamChatMessage {
+	return &StreamChatMessage{Name: msg.name, Login: msg.login, Anon: msg.anon, Text: msg.text, Action: msg.action, Bot: msg.bot}
+}
+
+func (msg ChatMessage) method() string {
+	if msg.action {
+		return "Chat.Action"
+	}
+	return "Chat.Message"
+}
+
+// The parameters of a `Chat.Message` (or `Chat.Action`) notification.
+func (msg ChatMessage) params() []interface{} {
+	return []interface{}{msg.name, msg.text, msg.login, msg.id, msg.time, msg.anon, msg.bot}
+}
+
+// The parameters of a message as seen by `ctx`. Anonymous sessions tie together messages
+// sent under different names, so only moderators, who need them to ban people, and relays,
+// which pass them on to their own moderators, get to see them.
+func (ctx *chatter) messageParams(msg ChatMessage) []interface{} {
+	if !ctx.relay && ctx.role() < ChatModerator {
+		msg.anon = ""
+	}
+	return msg.params()
+}
+
 func (ctx *chatter) pushMessage(msg ChatMessage) error {
-	return RPCPushEvent(ctx.socket, "Chat.Message", msg.name, msg.text, msg.login)
+	return RPCPushEvent(ctx.socket, msg.method(), ctx.messageParams(msg)...)
+}
+
+func (ctx *chatter) pushOnline() error {
+	if ctx.chat.online {
+		return RPCPushEvent(ctx.socket, "Stream.Online")
+	}
+	return RPCPushEvent(ctx.socket, "Stream.Offline")
 }
 
 func (ctx *chatter) pushViewerCount() error {
-	return RPCPushEvent(ctx.socket, "Stream.ViewerCount", len(ctx.chat.Users))
+	// Some people may be chatting without watching (or not watching yet).
+	n := ctx.chat.viewers
+	if users := ctx.chat.userCount(); users > n {
+		n = users
+	}
+	return RPCPushEvent(ctx.socket, "Stream.ViewerCount", n)
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChatClosed(t *testing.T) {
+	chat := NewChat(20)
+	chat.Close()
+	select {
+	case <-chat.done:
+	case <-time.After(time.Second):
+		t.Fatal("an empty chat did not stop after closing")
+	}
+	// Nothing reads events anymore, but none of these should block.
+	chat.Notify("Chat.Test")
+	chat.SetOnline(true, 1)
+	chat.Close()
+	if chat.Connect(nil, nil, false, "") != nil {
+		t.Fatal("joined a closed chat")
+	}
+}
+
+// Join a chat through a websocket, same as a viewer would.
+func testChatClient(t *testing.T, chat *Chat, user *UserData) *websocket.Conn {
+	return testChatClientAnon(t, chat, user, "")
+}
+
+// Same as `testChatClient`, but with an anonymous session kept in a cookie.
+func testChatClientAnon(t *testing.T, chat *Chat, user *UserData, anon string) *websocket.Conn {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		chat.RunRPC(ws, user, false, anon, nil)
+	}))
+	t.Cleanup(server.Close)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/stream/alice", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	testChatEvent(t, ws, "RPC.Loaded")
+	return ws
+}
+
+// Skip notifications until one with the given method, then return its parameters.
+func testChatEvent(t *testing.T, ws *websocket.Conn, method string) []json.RawMessage {
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for {
+		var msg struct {
+			Method string
+			Params []json.RawMessage
+		}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("expected %s, got %v", method, err)
+		}
+		if msg.Method == method {
+			return msg.Params
+		}
+	}
+}
+
+func TestChatMove(t *testing.T) {
+	chat := NewChat(20)
+	defer chat.Close()
+	ws := testChatClient(t, chat, nil)
+	chat.Move("b:8000")
+	params := testChatEvent(t, ws, "RPC.Redirect")
+	if len(params) != 1 || string(params[0]) != `"//b:8000/stream/alice"` {
+		t.Fatalf("expected a redirect to b:8000, got %s", params)
+	}
+}
+
+func TestChatSaveMessages(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/chat.db")
+	testSQLStreamer(t, db, "alice")
+	session, err := db.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(20)
+	defer chat.Close()
+	chat.db = db
+	chat.stream = "alice"
+	chat.SetOnline(true, session)
+	chat.Notify("Chat.Test") // `handle` is done with `SetOnline` once it takes this
+	chat.postMessage(ChatMessage{name: "Bob", login: "bob", text: "hello"})
+	messages, err := db.GetChatReplay(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Text != "hello" {
+		t.Fatalf("expected the message to be saved with the session, got %+v", messages)
+	}
+}
+
+func TestChatRoleChanged(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/roles.db")
+	testSQLStreamer(t, db, "alice")
+	testSQLStreamer(t, db, "bob")
+	chat := NewChat(20)
+	defer chat.Close()
+	chat.db = db
+	chat.stream = "alice"
+	joined := make(chan *chatter, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		joined <- chat.Connect(ws, &UserData{Login: "bob"}, false, "x")
+		websocket.Message.Receive(ws, new(string))
+	}))
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/stream/alice", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	bob := <-joined
+	if bob.role() != ChatUser {
+		t.Fatalf("expected bob to join as a user, got %v", bob.role())
+	}
+	owner := &chatter{chat: chat, login: "alice", rank: int32(ChatOwner)}
+	if err := owner.AddModerator(&RPCSingleStringArg{"bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	chat.Notify("Chat.Test") // `handle` is done with `chatRole` once it takes this
+	if bob.role() != ChatModerator {
+		t.Fatalf("expected bob to become a moderator without reconnecting, got %v", bob.role())
+	}
+	if err := owner.RemoveModerator(&RPCSingleStringArg{"bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	chat.Notify("Chat.Test")
+	if bob.role() != ChatUser {
+		t.Fatalf("expected bob to stop being a moderator, got %v", bob.role())
+	}
+}
+
+func TestChatClosedReleasesName(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/names.db")
+	testSQLStreamer(t, db, "alice")
+	chat := NewChat(20)
+	chat.db = db
+	chat.stream = "alice"
+	chat.Close()
+	joined := make(chan *chatter, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		joined <- chat.Connect(ws, &UserData{Login: "bob", Name: "Bob"}, false, "x")
+	}))
+	defer server.Close()
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/stream/alice", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if <-joined != nil {
+		t.Fatal("joined a closed chat")
+	}
+	if login, anon, err := db.GetChatNameOwner("alice", "Bob"); err != ErrUserNotExist {
+		t.Fatalf("expected the name to be released, got %q/%q, %v", login, anon, err)
+	}
+}
+
+func TestChatBanNotifications(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/bans.db")
+	testSQLStreamer(t, db, "alice")
+	chat := NewChat(20)
+	defer chat.Close()
+	chat.db = db
+	chat.stream = "alice"
+	owner := testChatClient(t, chat, &UserData{Login: "alice", Name: "Alice"})
+	viewer := testChatClient(t, chat, nil)
+	troll := testChatClientAnon(t, chat, nil, "trolls-session")
+	chat.postMessage(ChatMessage{name: "Troll", text: "hi", anon: "trolls-session"})
+	// Only moderators can tell which session a message came from.
+	if params := testChatEvent(t, owner, "Chat.Message"); len(params) != 7 || string(params[5]) != `"trolls-session"` {
+		t.Fatalf("expected the owner to see the session, got %s", params)
+	}
+	if params := testChatEvent(t, viewer, "Chat.Message"); len(params) != 7 || string(params[5]) != `""` {
+		t.Fatalf("expected the session to be hidden from viewers, got %s", params)
+	}
+	err := websocket.JSON.Send(owner, map[string]interface{}{
+		"jsonrpc": "2.0", "id": 1, "method": "Chat.Timeout", "params": []interface{}{"", "trolls-session", 60},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params := testChatEvent(t, troll, "Chat.Banned"); len(params) != 1 || string(params[0]) != "60" {
+		t.Fatalf("expected the troll to be told about the timeout, got %s", params)
+	}
+	if params := testChatEvent(t, owner, "Chat.UserBanned"); len(params) != 4 || string(params[3]) != `"Alice"` {
+		t.Fatalf("expected the moderators to be told who did it, got %s", params)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/gorilla/securecookie"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -15,31 +16,54 @@ type Context struct {
 	// how long to keep a stream online after the broadcaster has disconnected.
 	// if the stream does not resume within this time, all clients get dropped.
 	StreamKeepAlive time.Duration
+	// how long the broadcaster may stay silent before viewers are shown the slate.
+	StreamSlateDelay time.Duration
+	// whether to pass Matroska tags from the broadcaster through to viewers.
+	ForwardTags bool
+	// whether to serve viewers of streams on other nodes through this one
+	// instead of redirecting them.
+	ProxyViewers bool
+	// above these limits (0 = none), new broadcasters are sent to an idler node.
+	MaxIngests int
+	MaxEgress  int64 // bytes per second
 
 	cookieCodec *securecookie.SecureCookie
 }
 
-func (c *Context) GetAuthInfo(r *http.Request) (*UserData, error) {
+func (c *Context) codec() *securecookie.SecureCookie {
 	if c.cookieCodec == nil {
 		c.cookieCodec = securecookie.New(c.SecureKey, nil)
 	}
+	return c.cookieCodec
+}
+
+func (c *Context) GetAuthInfo(r *http.Request) (*UserData, error) {
 	var uid int64
 	if cookie, err := r.Cookie("uid"); err == nil {
-		if err = c.cookieCodec.Decode("uid", cookie.Value, &uid); err == nil {
+		if err = c.codec().Decode("uid", cookie.Value, &uid); err == nil {
 			return c.GetUserFull(uid)
 		}
 	}
 	return nil, ErrUserNotExist
 }
 
+// Same as `GetAuthInfo`, but also accepts an API token in an `Authorization: Bearer`
+// header, in which case the user is a bot. An invalid token is `ErrInvalidToken`
+// rather than `ErrUserNotExist`, as the bot should not end up anonymous.
+func (c *Context) GetChatAuthInfo(r *http.Request) (*UserData, bool, error) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		user, err := c.GetUserByAPIToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		return user, true, err
+	}
+	user, err := c.GetAuthInfo(r)
+	return user, false, err
+}
+
 func (c *Context) SetAuthInfo(w http.ResponseWriter, id int64) error {
 	if id == -1 {
 		http.SetCookie(w, &http.Cookie{Name: "uid", Value: "", Path: "/", MaxAge: 0})
 	} else {
-		if c.cookieCodec == nil {
-			c.cookieCodec = securecookie.New(c.SecureKey, nil)
-		}
-		enc, err := c.cookieCodec.Encode("uid", id)
+		enc, err := c.codec().Encode("uid", id)
 		if err != nil {
 			return err
 		}
@@ -49,3 +73,43 @@ func (c *Context) SetAuthInfo(w http.ResponseWriter, id int64) error {
 	}
 	return nil
 }
+
+// Anonymous chatters are told apart by a random ID so that they can be banned.
+// `SetAnonID` stores it in a cookie when the room is opened; without the cookie,
+// this returns an empty string, and the chat makes up an ID that only lasts
+// as long as the connection (see `Chat.Connect`).
+func (c *Context) GetAnonID(r *http.Request) string {
+	var id string
+	if cookie, err := r.Cookie("anon"); err == nil {
+		if err = c.codec().Decode("anon", cookie.Value, &id); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+func (c *Context) SetAnonID(w http.ResponseWriter, r *http.Request) error {
+	if cookie, err := r.Cookie("anon"); err == nil && c.codec().Decode("anon", cookie.Value, new(string)) == nil {
+		return nil
+	}
+	enc, err := c.codec().Encode("anon", makeToken(16))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: "anon", Value: enc, Path: "/", HttpOnly: true, MaxAge: 31536000,
+	})
+	return nil
+}
+
+// Other nodes send this in `relayHeader` to show that they are a part of the cluster
+// (i.e. have the same key) and are relaying the stream rather than watching it.
+func (c *Context) RelayToken(id string) (string, error) {
+	return c.codec().Encode("relay", id)
+}
+
+func (c *Context) IsRelay(r *http.Request, id string) bool {
+	var relayed string
+	token := r.Header.Get(relayHeader)
+	return token != "" && c.codec().Decode("relay", token, &relayed) == nil && relayed == id
+}
@@ -1,14 +1,31 @@
 package main
 
-import "sync"
+import (
+	"strings"
+	"sync"
+	"time"
+)
 
 type anonymousDAO struct {
 	active map[string]*StreamMetadata
 	*sync.RWMutex
+	names *anonChatNames
+}
+
+// There are no users, so there are no logins to reserve either.
+type anonChatNames struct {
+	claims map[int64]anonChatName
+	last   int64
+}
+
+type anonChatName struct {
+	stream string
+	name   string
+	anon   string
 }
 
 func NewAnonDatabase() Database {
-	return anonymousDAO{make(map[string]*StreamMetadata), new(sync.RWMutex)}
+	return anonymousDAO{make(map[string]*StreamMetadata), new(sync.RWMutex), &anonChatNames{claims: make(map[int64]anonChatName)}}
 }
 
 func (d anonymousDAO) Close() error {
@@ -39,6 +56,10 @@ func (d anonymousDAO) GetUserFull(id int64) (*UserData, error) {
 	return nil, ErrUserNotExist
 }
 
+func (d anonymousDAO) GetUserByAPIToken(token string) (*UserData, error) {
+	return nil, ErrInvalidToken
+}
+
 func (d anonymousDAO) SetUserData(id int64, name string, login string, email string, about string, password []byte) (string, error) {
 	return "", ErrNotSupported
 }
@@ -47,7 +68,15 @@ func (d anonymousDAO) NewStreamToken(id int64) error {
 	return ErrNotSupported
 }
 
-func (d anonymousDAO) SetStreamName(id int64, name string, nsfw bool) error {
+func (d anonymousDAO) NewAPIToken(id int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) DelAPIToken(id int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) SetStreamName(id int64, name string, nsfw bool, paced bool, captions bool) error {
 	return ErrNotSupported
 }
 
@@ -63,6 +92,10 @@ func (d anonymousDAO) DelStreamPanel(id int64, n int64) error {
 	return ErrNotSupported
 }
 
+func (d anonymousDAO) SetStreamSlate(id int64, data []byte) error {
+	return ErrNotSupported
+}
+
 func (d anonymousDAO) StartStream(id string, token string) error {
 	d.Lock()
 	if _, ok := d.active[id]; !ok {
@@ -110,6 +143,21 @@ func (d anonymousDAO) SetStreamTrackInfo(id string, info *StreamTrackInfo) error
 	return ErrStreamNotExist
 }
 
+func (d anonymousDAO) SetStreamTags(id string, tags map[string]string) error {
+	d.RLock()
+	if item, ok := d.active[id]; ok {
+		item.Tags = tags
+		d.RUnlock()
+		return nil
+	}
+	d.RUnlock()
+	return ErrStreamNotExist
+}
+
+func (d anonymousDAO) GetStreamSlate(id string) ([]byte, error) {
+	return nil, nil
+}
+
 func (d anonymousDAO) GetRecordings(id string) (*StreamHistory, error) {
 	return nil, ErrUserNotExist
 }
@@ -118,7 +166,203 @@ func (d anonymousDAO) GetRecording(id string, recid int64) (*StreamRecording, er
 	return nil, ErrNotSupported
 }
 
-func (d anonymousDAO) StartRecording(id string, filename string) (recid int64, sizeLimit int64, e error) {
+func (d anonymousDAO) SetNodeLoad(load NodeLoad) error {
+	return nil
+}
+
+func (d anonymousDAO) GetIdlestNode() (string, *NodeLoad, error) {
+	return "", nil, ErrNotSupported
+}
+
+func (d anonymousDAO) GetRoomServer(id string) (string, error) {
+	return "", nil
+}
+
+func (d anonymousDAO) SetRelayViewers(id string, viewers int) error {
+	return nil
+}
+
+func (d anonymousDAO) GetRelayViewers(id string) (int, error) {
+	return 0, nil
+}
+
+func (d anonymousDAO) StartSession(id string) (int64, error) {
+	return 0, nil
+}
+
+func (d anonymousDAO) SetSessionViewers(session int64, viewers int) error {
+	return nil
+}
+
+func (d anonymousDAO) AddChatMessage(id string, session int64, msg *StreamChatMessage) (int64, error) {
+	return 0, nil
+}
+
+func (d anonymousDAO) GetChatReplay(session int64) ([]StreamChatMessage, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) GetChatHistory(id string, before int64, limit int) ([]StreamChatMessage, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) ClearChatHistory(id string) error {
+	return nil
+}
+
+func (d anonymousDAO) DelChatMessage(id string, msgid int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetChatRole(id string, login string) (ChatRole, error) {
+	return ChatUser, nil
+}
+
+func (d anonymousDAO) GetChatAnonRole(id string, anon string) (ChatRole, error) {
+	return ChatUser, nil
+}
+
+func (d anonymousDAO) AddChatModerator(id string, login string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) DelChatModerator(id string, login string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) AddChatBan(id string, login string, anon string, seconds int) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) DelChatBan(id string, login string, anon string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetChatBan(id string, login string, anon string) (bool, time.Time, error) {
+	return false, time.Time{}, nil
+}
+
+func (d anonymousDAO) ClaimChatName(id string, name string, login string, anon string) (int64, error) {
+	d.Lock()
+	defer d.Unlock()
+	claim := anonChatName{id, strings.ToLower(name), anon}
+	for _, other := range d.names.claims {
+		if other.stream == claim.stream && other.name == claim.name && other.anon != claim.anon {
+			return 0, ErrUserNotUnique
+		}
+	}
+	d.names.last++
+	d.names.claims[d.names.last] = claim
+	return d.names.last, nil
+}
+
+func (d anonymousDAO) ReleaseChatName(claim int64) error {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.names.claims, claim)
+	return nil
+}
+
+func (d anonymousDAO) GetChatNameOwner(id string, name string) (string, string, error) {
+	d.RLock()
+	defer d.RUnlock()
+	for _, claim := range d.names.claims {
+		if claim.stream == id && claim.name == strings.ToLower(name) {
+			return "", claim.anon, nil
+		}
+	}
+	return "", "", ErrUserNotExist
+}
+
+func (d anonymousDAO) AddChatBlock(login string, anon string, name string, blockedLogin string, blockedAnon string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) DelChatBlock(login string, anon string, name string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) IsChatUserBlocked(login string, anon string, byLogin string, byAnon string) (bool, error) {
+	return false, nil
+}
+
+func (d anonymousDAO) SetChatCommand(id string, name string, text string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetChatCommand(id string, name string) (string, error) {
+	return "", nil
+}
+
+func (d anonymousDAO) SetChatSlowMode(id string, seconds int) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetChatSlowMode(id string) (int, error) {
+	return 0, nil
+}
+
+func (d anonymousDAO) AddChatPoll(id string, question string, options []string, seconds int) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (d anonymousDAO) EndChatPoll(id string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetChatPoll(id string) (*StreamPoll, error) {
+	return nil, ErrPollNotExist
+}
+
+func (d anonymousDAO) AddChatVote(pollid int64, option int, login string, anon string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetStreamPolls(session int64) ([]StreamPoll, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) GetChatFilters(id string) (*ChatFilters, error) {
+	return &ChatFilters{}, nil
+}
+
+func (d anonymousDAO) AddChatFilterRule(id string, rule ChatFilterRule) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (d anonymousDAO) DelChatFilterRule(id string, ruleid int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) SetChatLinkPolicy(id string, policy ChatLinkPolicy, action ChatFilterAction) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) SetChatCapsLimit(id string, percent int, action ChatFilterAction) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) AddHeldMessage(id string, msg *StreamChatMessage, reason string) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (d anonymousDAO) GetHeldMessages(id string) ([]StreamHeldMessage, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) TakeHeldMessage(id string, heldid int64) (*StreamHeldMessage, error) {
+	return nil, ErrMessageNotExist
+}
+
+func (d anonymousDAO) AddStreamMarker(session int64, timecode uint64, label string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) GetStreamMarkers(session int64) ([]StreamMarker, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) StartRecording(id string, session int64, filename string) (recid int64, sizeLimit int64, e error) {
 	return 0, 0, nil
 }
 
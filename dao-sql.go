@@ -2,8 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 )
 
 type sqlDAO struct {
@@ -15,6 +21,13 @@ type sqlDAO struct {
 	// in a separate request, which may or may not overload the database...
 	streamTokenLock sync.RWMutex
 	streamTokens    map[string]string
+	// Tells this process apart from others with the same address, e.g. the one
+	// it has replaced on SIGUSR2 that is still serving existing connections.
+	// Each has its own lease; streams are claimed by a process, not an address.
+	instance string
+	// Closed to stop renewing this process's lease in `nodes`. Streams claimed
+	// by a process whose lease has expired are considered offline.
+	stopHeartbeat chan struct{}
 
 	prepared struct {
 		UserExists      *sql.Stmt "select 1 from users where login = ? or email = ?"
@@ -25,23 +38,86 @@ type sqlDAO struct {
 		ActivateUser    *sql.Stmt "update users set actoken = NULL where id = ? and actoken = ?"
 		GetUserID       *sql.Stmt "select id, pwhash from users where login = ?"
 		GetUserByEither *sql.Stmt "select id from users where login = ? or email = ?"
-		GetUserInfo     *sql.Stmt "select name, login, email, pwhash, about, actoken, sectoken from users where id = ?"
-		GetStreamInfo   *sql.Stmt "select users.id, users.name, about, email, streams.name, server, video, audio, width, height, nsfw, streams.id from users join streams on users.id = streams.user where login = ?"
+		GetUserInfo     *sql.Stmt "select name, login, email, pwhash, about, actoken, sectoken, (select token from apitokens where user = users.id) from users where id = ?"
+		GetStreamInfo   *sql.Stmt "select users.id, users.name, about, email, streams.name, case when instance in (select instance from nodes where expires > datetime('now')) then server end, video, audio, width, height, nsfw, paced, captions, tags, streams.id from users join streams on users.id = streams.user where login = ?"
 		SetStreamToken  *sql.Stmt "update users set sectoken = ? where id = ?"
-		SetStreamName   *sql.Stmt "update streams set name = ?, nsfw = ? where user = ?"
+		SetAPIToken     *sql.Stmt "insert or replace into apitokens(user, token) values (?, ?)"
+		DelAPIToken     *sql.Stmt "delete from apitokens where user = ?"
+		GetAPITokenUser *sql.Stmt "select user from apitokens where token = ?"
+		SetStreamName   *sql.Stmt "update streams set name = ?, nsfw = ?, paced = ?, captions = ? where user = ?"
 		SetStreamTracks *sql.Stmt "update streams set video = ?, audio = ?, width = ?, height = ? where user in (select id from users where login = ?)"
+		SetStreamTags   *sql.Stmt "update streams set tags = ? where user in (select id from users where login = ?)"
 		GetStreamPanels *sql.Stmt "select text, image, created from panels where stream = ?"
 		AddStreamPanel  *sql.Stmt "insert into panels(stream, text) select id, ? from streams where user = ?"
 		SetStreamPanel  *sql.Stmt "update panels set text = ? where id in (select id from panels where stream in (select id from streams where user = ?) limit 1 offset ?)"
 		DelStreamPanel  *sql.Stmt "delete from panels where id in (select id from panels where stream in (select id from streams where user = ?) limit 1 offset ?)"
-		GetStreamAuth   *sql.Stmt "select server, sectoken, actoken is null from users join streams on users.id = streams.user where users.login = ?"
-		GetStreamServer *sql.Stmt "select server from streams where user in (select id from users where login = ?)"
-		SetStreamServer *sql.Stmt "update streams set server = ? where server is null and user in (select id from users where login = ? and actoken is null and sectoken = ?)"
-		DelStreamServer *sql.Stmt "update streams set server = null where user in (select id from users where login = ?)"
+		SetStreamSlate  *sql.Stmt "update streams set slate = ? where user = ?"
+		GetStreamSlate  *sql.Stmt "select slate from streams where user in (select id from users where login = ?)"
+		GetStreamAuth   *sql.Stmt "select server, instance, sectoken, actoken is null from users join streams on users.id = streams.user where users.login = ?"
+		GetStreamServer *sql.Stmt "select server, instance, instance in (select instance from nodes where expires > datetime('now')) from streams where user in (select id from users where login = ?)"
+		SetStreamServer *sql.Stmt "update streams set server = ?, instance = ?, room = ? where (instance is null or instance = ? or instance not in (select instance from nodes where expires > datetime('now'))) and user in (select id from users where login = ? and actoken is null and sectoken = ?)"
+		DelStreamServer *sql.Stmt "update streams set server = null, instance = null where instance is ? and user in (select id from users where login = ?)"
+		GetOwnStreams   *sql.Stmt "select login, sectoken from users join streams on users.id = streams.user where instance = ?"
+		RenewLease      *sql.Stmt "insert into nodes(instance, server, expires) values(?, ?, datetime('now', ?)) on conflict(instance) do update set expires = excluded.expires"
+		SetNodeLoad     *sql.Stmt "update nodes set ingests = ?, viewers = ?, egress = ?, draining = ? where instance = ?"
+		GetIdlestNode   *sql.Stmt "select server, ingests, viewers, egress from nodes where expires > datetime('now') and not draining and server != ? order by egress, ingests limit 1"
+		ReleaseLease    *sql.Stmt "delete from nodes where instance = ?"
 		GetRecordings1  *sql.Stmt "select id, name, about, email, space_total from users where login = ?"
 		GetRecordings2  *sql.Stmt "select id, name, server, path, created, size from recordings where user = ? order by datetime(created) desc"
 		GetRecordPanels *sql.Stmt "select text, image, created from panels where stream = ? and datetime(created) <= datetime(?)"
-		GetRecording    *sql.Stmt "select users.id, users.name, about, email, recordings.name, server, video, audio, width, height, nsfw, path, size, created, stream from users join recordings on users.id = user where recordings.id = ?"
+		GetRecording    *sql.Stmt "select users.id, users.name, about, email, recordings.name, server, video, audio, width, height, nsfw, path, size, created, stream, session from users join recordings on users.id = user where recordings.id = ?"
+		GetSpaceLeft    *sql.Stmt "select space_total - (select coalesce(sum(size), 0) from recordings where user = users.id) from users where login = ?"
+		StartRecording  *sql.Stmt "insert into recordings(stream, user, session, video, audio, nsfw, width, height, name, server, path) select id, user, ?, video, audio, nsfw, width, height, name, ?, ? from streams where user in (select id from users where login = ?)"
+		StopRecording   *sql.Stmt "update recordings set size = ? where id = ?"
+		StartSession    *sql.Stmt "insert into sessions(stream, server, instance) select id, ?, ? from streams where user in (select id from users where login = ?)"
+		SetRoomServer   *sql.Stmt "update streams set room = ? where (room is null or room not in (select server from nodes where expires > datetime('now'))) and user in (select id from users where login = ?)"
+		GetRoomServer   *sql.Stmt "select room from streams where user in (select id from users where login = ?)"
+		SetRelayViewers *sql.Stmt "insert into relays(stream, server, viewers) select id, ?, ? from streams where user in (select id from users where login = ?) on conflict(stream, server) do update set viewers = excluded.viewers"
+		GetRelayViewers *sql.Stmt "select coalesce(sum(viewers), 0) from relays where server in (select server from nodes where expires > datetime('now')) and stream in (select id from streams where user in (select id from users where login = ?))"
+		SetPeakViewers  *sql.Stmt "update sessions set peak = max(peak, ?) where id = ?"
+		StopSession     *sql.Stmt "update sessions set ended = datetime('now') where ended is null and instance = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		AddMarker       *sql.Stmt "insert into markers(session, timecode, label) values(?, ?, ?)"
+		GetMarkers      *sql.Stmt "select timecode, label from markers where session = ? order by timecode"
+		AddChatMessage  *sql.Stmt "insert into messages(stream, session, name, login, anon, text, action, bot) select id, nullif(?, 0), ?, ?, ?, ?, ?, ? from streams where user in (select id from users where login = ?)"
+		GetChatReplay   *sql.Stmt "select id, name, login, anon, text, action, bot, created from messages where session = ? order by id"
+		GetChatHistory  *sql.Stmt "select id, name, login, anon, text, action, bot, created from messages where id < ? and not cleared and stream in (select id from streams where user in (select id from users where login = ?)) order by id desc limit ?"
+		ClearChat       *sql.Stmt "update messages set cleared = 1 where not cleared and stream in (select id from streams where user in (select id from users where login = ?))"
+		DelChatMessage  *sql.Stmt "delete from messages where id = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		GetChatRole     *sql.Stmt "select case when streams.user = users.id then 2 when users.id in (select user from moderators where stream = streams.id) then 1 else 0 end from streams, users where streams.user in (select id from users where login = ?) and users.login = ?"
+		AddModerator    *sql.Stmt "insert or ignore into moderators(stream, user) select streams.id, users.id from streams, users where streams.user in (select id from users where login = ?) and users.login = ?"
+		DelModerator    *sql.Stmt "delete from moderators where stream in (select id from streams where user in (select id from users where login = ?)) and user in (select id from users where login = ?)"
+		AddChatBan      *sql.Stmt "insert into bans(stream, login, anon, expires) select id, ?, ?, case when ? > 0 then datetime('now', ? || ' seconds') end from streams where user in (select id from users where login = ?)"
+		DelChatBan      *sql.Stmt "delete from bans where stream in (select id from streams where user in (select id from users where login = ?)) and ((login != '' and login = ?) or (anon != '' and anon = ?))"
+		ClaimChatName   *sql.Stmt "insert into chatnames(stream, name, login, anon, instance) select id, ?, ?, ?, ? from streams where user in (select id from users where login = ?) and not exists (select 1 from users where login = ? collate nocase and login != ?) and not exists (select 1 from chatnames where stream = streams.id and name = ? collate nocase and instance in (select instance from nodes where expires > datetime('now')) and not ((? != '' and login = ?) or (? = '' and login = '' and anon = ?)))"
+		FreeChatName    *sql.Stmt "delete from chatnames where id = ?"
+		FreeOwnNames    *sql.Stmt "delete from chatnames where instance = ?"
+		GetAnonRole     *sql.Stmt "select coalesce(max(case when streams.user = users.id then 2 when users.id in (select user from moderators where stream = streams.id) then 1 else 0 end), 0) from streams, users where streams.user in (select id from users where login = ?) and users.login in (select login from messages where stream = streams.id and anon = ? union select login from heldmessages where stream = streams.id and anon = ? union select login from chatnames where stream = streams.id and anon = ?)"
+		GetNameOwner    *sql.Stmt "select login, anon from chatnames where stream in (select id from streams where user in (select id from users where login = ?)) and name = ? collate nocase and instance in (select instance from nodes where expires > datetime('now')) limit 1"
+		SetChatCommand  *sql.Stmt "insert into commands(stream, name, text) select id, ?, ? from streams where user in (select id from users where login = ?) on conflict(stream, name) do update set text = excluded.text"
+		DelChatCommand  *sql.Stmt "delete from commands where name = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		GetChatCommand  *sql.Stmt "select text from commands where name = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		SetSlowMode     *sql.Stmt "update streams set slowmode = ? where user in (select id from users where login = ?)"
+		GetSlowMode     *sql.Stmt "select slowmode from streams where user in (select id from users where login = ?)"
+		AddChatBlock    *sql.Stmt "insert into blocks(login, anon, name, blocked_login, blocked_anon) values (?, ?, ?, ?, ?)"
+		DelChatBlock    *sql.Stmt "delete from blocks where ((? != '' and login = ?) or (? = '' and login = '' and anon = ?)) and name = ? collate nocase"
+		IsChatBlocked   *sql.Stmt "select 1 from blocks where ((? != '' and login = ?) or (? = '' and login = '' and anon = ?)) and ((blocked_login != '' and blocked_login = ?) or (blocked_anon != '' and blocked_anon = ?)) limit 1"
+		AddChatPoll     *sql.Stmt "insert into polls(stream, session, question, options, ends) select id, (select max(id) from sessions where stream = streams.id and ended is null), ?, ?, datetime('now', ? || ' seconds') from streams where user in (select id from users where login = ?) and not exists (select 1 from polls where stream = streams.id and ends > datetime('now'))"
+		EndChatPoll     *sql.Stmt "update polls set ends = datetime('now') where ends > datetime('now') and stream in (select id from streams where user in (select id from users where login = ?))"
+		GetChatPoll     *sql.Stmt "select id, question, options, ends, ends > datetime('now') from polls where stream in (select id from streams where user in (select id from users where login = ?)) order by id desc limit 1"
+		GetSessionPolls *sql.Stmt "select id, question, options, ends, ends > datetime('now') from polls where session = ? order by id"
+		GetPollVotes    *sql.Stmt "select option, count(*) from votes where poll = ? group by option"
+		AddChatVote     *sql.Stmt "insert into votes(poll, option, login, anon) select id, ?, ?, ? from polls where id = ? and ends > datetime('now') and not exists (select 1 from votes where poll = polls.id and ((? != '' and login = ?) or (? = '' and login = '' and anon = ?)))"
+		GetChatFilters  *sql.Stmt "select links, linkaction, maxcaps, capsaction from filters where stream in (select id from streams where user in (select id from users where login = ?))"
+		GetFilterRules  *sql.Stmt "select id, pattern, regex, action from filterrules where stream in (select id from streams where user in (select id from users where login = ?)) order by id"
+		AddFilterRule   *sql.Stmt "insert into filterrules(stream, pattern, regex, action) select id, ?, ?, ? from streams where user in (select id from users where login = ?)"
+		DelFilterRule   *sql.Stmt "delete from filterrules where id = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		SetLinkPolicy   *sql.Stmt "insert into filters(stream, links, linkaction) select id, ?, ? from streams where user in (select id from users where login = ?) on conflict(stream) do update set links = excluded.links, linkaction = excluded.linkaction"
+		SetCapsLimit    *sql.Stmt "insert into filters(stream, maxcaps, capsaction) select id, ?, ? from streams where user in (select id from users where login = ?) on conflict(stream) do update set maxcaps = excluded.maxcaps, capsaction = excluded.capsaction"
+		AddHeldMessage  *sql.Stmt "insert into heldmessages(stream, name, login, anon, text, action, bot, reason) select id, ?, ?, ?, ?, ?, ?, ? from streams where user in (select id from users where login = ?)"
+		GetHeldMessages *sql.Stmt "select id, name, login, anon, text, action, bot, created, reason from heldmessages where stream in (select id from streams where user in (select id from users where login = ?)) order by id"
+		GetHeldMessage  *sql.Stmt "select id, name, login, anon, text, action, bot, created, reason from heldmessages where id = ? and stream in (select id from streams where user in (select id from users where login = ?))"
+		DelHeldMessage  *sql.Stmt "delete from heldmessages where id = ?"
+		GetChatBan      *sql.Stmt "select expires from bans where stream in (select id from streams where user in (select id from users where login = ?)) and ((login != '' and login = ?) or (anon != '' and anon = ?)) and (expires is null or expires > datetime('now')) order by expires is not null, expires desc limit 1"
 	}
 }
 
@@ -66,10 +142,17 @@ create table if not exists streams (
     video      boolean      not null default 1,
     audio      boolean      not null default 1,
     nsfw       boolean      not null default 0,
+    paced      boolean      not null default 0,
+    captions   boolean      not null default 0,
+    tags       text         not null default "{}",
     width      integer      not null default 0,
     height     integer      not null default 0,
     name       varchar(256) not null default "",
-    server     varchar(128)
+    server     varchar(128),
+    instance   varchar(64),
+    room       varchar(128),
+    slowmode   integer      not null default 0,
+    slate      blob
 );
 
 create table if not exists panels (
@@ -93,25 +176,278 @@ create table if not exists recordings (
     server     varchar(128) not null,
     path       varchar(256) not null,
     created    datetime     not null default (datetime('now')),
-    size       integer      not null default 0
+    size       integer      not null default 0,
+    session    integer      not null default 0
+);
+
+create table if not exists nodes (
+    instance   varchar(64)  not null primary key,
+    server     varchar(128) not null,
+    expires    datetime     not null,
+    ingests    integer      not null default 0,
+    viewers    integer      not null default 0,
+    egress     integer      not null default 0,
+    draining   boolean      not null default 0
+);
+
+create table if not exists sessions (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    server     varchar(128) not null,
+    instance   varchar(64)  not null default "",
+    started    datetime     not null default (datetime('now')),
+    ended      datetime,
+    peak       integer      not null default 0
+);
+
+create table if not exists relays (
+    stream     integer      not null,
+    server     varchar(128) not null,
+    viewers    integer      not null default 0,
+    primary key (stream, server)
+);
+
+create table if not exists markers (
+    id         integer      not null primary key,
+    session    integer      not null,
+    timecode   integer      not null,
+    label      varchar(256) not null,
+    created    datetime     not null default (datetime('now'))
+);
+
+create table if not exists messages (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    session    integer,
+    name       varchar(256) not null,
+    login      varchar(256) not null default "",
+    anon       varchar(64)  not null default "",
+    text       text         not null,
+    action     boolean      not null default 0,
+    cleared    boolean      not null default 0,
+    bot        boolean      not null default 0,
+    created    datetime     not null default (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+create table if not exists chatnames (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    name       varchar(256) not null,
+    login      varchar(256) not null default "",
+    anon       varchar(64)  not null default "",
+    instance   varchar(64)  not null
+);
+
+create table if not exists commands (
+    stream     integer      not null,
+    name       varchar(32)  not null,
+    text       text         not null,
+    primary key(stream, name)
+);
+
+create table if not exists moderators (
+    stream     integer      not null,
+    user       integer      not null,
+    primary key(stream, user)
+);
+
+create table if not exists bans (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    login      varchar(256) not null default "",
+    anon       varchar(64)  not null default "",
+    expires    datetime,
+    created    datetime     not null default (datetime('now'))
+);
+
+create table if not exists polls (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    session    integer,
+    question   varchar(256) not null,
+    options    text         not null,
+    ends       datetime     not null,
+    created    datetime     not null default (datetime('now'))
+);
+
+create table if not exists votes (
+    poll       integer      not null,
+    option     integer      not null,
+    login      varchar(256) not null default "",
+    anon       varchar(64)  not null default ""
+);
+
+create table if not exists filters (
+    stream     integer      not null primary key,
+    links      integer      not null default 0,
+    linkaction integer      not null default 0,
+    maxcaps    integer      not null default 0,
+    capsaction integer      not null default 0
+);
+
+create table if not exists filterrules (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    pattern    varchar(256) not null,
+    regex      boolean      not null default 0,
+    action     integer      not null default 0
+);
+
+create table if not exists heldmessages (
+    id         integer      not null primary key,
+    stream     integer      not null,
+    name       varchar(256) not null,
+    login      varchar(256) not null default "",
+    anon       varchar(64)  not null default "",
+    text       text         not null,
+    action     boolean      not null default 0,
+    bot        boolean      not null default 0,
+    reason     varchar(256) not null,
+    created    datetime     not null default (datetime('now'))
+);
+
+create table if not exists apitokens (
+    user       integer      not null primary key,
+    token      varchar(64)  not null,
+    created    datetime     not null default (datetime('now')),
+    unique(token)
+);
+
+create table if not exists blocks (
+    id            integer      not null primary key,
+    login         varchar(256) not null default "",
+    anon          varchar(64)  not null default "",
+    name          varchar(256) not null,
+    blocked_login varchar(256) not null default "",
+    blocked_anon  varchar(64)  not null default ""
 );`
 
 func NewSQLDatabase(localhost string, driver string, server string) (Database, error) {
 	db, err := sql.Open(driver, server)
 	if err == nil {
-		wrapped := &sqlDAO{DB: *db, localhost: localhost, streamTokens: make(map[string]string)}
+		wrapped := &sqlDAO{DB: *db, localhost: localhost, instance: makeToken(tokenLength), streamTokens: make(map[string]string)}
 		if err = wrapped.prepare(); err == nil {
-			return wrapped, nil
+			if err = wrapped.renewLease(); err == nil {
+				wrapped.stopHeartbeat = make(chan struct{})
+				go wrapped.heartbeat()
+				return wrapped, nil
+			}
 		}
-		wrapped.Close()
+		wrapped.DB.Close()
 	}
 	return nil, err
 }
 
+const (
+	sqlLeaseInterval = 5 * time.Second
+	sqlLeaseTimeout  = "+15 seconds"
+)
+
+func (d *sqlDAO) renewLease() error {
+	return errOf(d.prepared.RenewLease.Exec(d.instance, d.localhost, sqlLeaseTimeout))
+}
+
+func (d *sqlDAO) heartbeat() {
+	ticker := time.NewTicker(sqlLeaseInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopHeartbeat:
+			return
+		case <-ticker.C:
+		}
+		if err := d.renewLease(); err != nil {
+			log.Println("Error renewing the lease: ", err)
+			continue
+		}
+		d.refreshTokens()
+	}
+}
+
+// Drop cached tokens that are no longer valid: either the owner has requested a new one
+// (possibly through a different server), or the lease has expired anyway (e.g. the database
+// was unreachable for too long) and another server has reclaimed the stream.
+func (d *sqlDAO) refreshTokens() {
+	rows, err := d.prepared.GetOwnStreams.Query(d.instance)
+	if err != nil {
+		log.Println("Error checking owned streams: ", err)
+		return
+	}
+	owned := make(map[string]string)
+	for id, token := "", ""; rows.Next() && rows.Scan(&id, &token) == nil; {
+		owned[id] = token
+	}
+	rows.Close()
+	d.streamTokenLock.Lock()
+	for id, token := range d.streamTokens {
+		if owned[id] != token {
+			delete(d.streamTokens, id)
+		}
+	}
+	d.streamTokenLock.Unlock()
+}
+
+func (d *sqlDAO) Close() error {
+	if d.stopHeartbeat != nil {
+		close(d.stopHeartbeat)
+		// Chat names claimed through this process are freed when its lease expires
+		// anyway, but there is no need to wait for that.
+		d.prepared.FreeOwnNames.Exec(d.instance)
+		d.prepared.ReleaseLease.Exec(d.instance)
+	}
+	return d.DB.Close()
+}
+
+// Columns added to tables that older databases already have, which `create table if not exists`
+// leaves as they were. Append only: `pragma user_version` is the number of entries applied.
+var sqlMigrations = []struct{ table, column, decl string }{
+	{"streams", "slate", "blob"},
+	{"streams", "paced", "boolean not null default 0"},
+	{"streams", "captions", "boolean not null default 0"},
+	{"streams", "tags", "text not null default '{}'"},
+	{"recordings", "session", "integer not null default 0"},
+	{"streams", "instance", "varchar(64)"},
+	{"sessions", "instance", "varchar(64) not null default ''"},
+	{"sessions", "peak", "integer not null default 0"},
+	{"streams", "room", "varchar(128)"},
+	{"messages", "anon", "varchar(64) not null default ''"},
+	{"streams", "slowmode", "integer not null default 0"},
+	{"messages", "action", "boolean not null default 0"},
+	{"messages", "cleared", "boolean not null default 0"},
+	{"messages", "bot", "boolean not null default 0"},
+	{"heldmessages", "bot", "boolean not null default 0"},
+}
+
+func (d *sqlDAO) migrate() error {
+	var version int
+	if err := d.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqlMigrations); version++ {
+		m := sqlMigrations[version]
+		// A table created by `sqlSchema` just now already has the column.
+		var found int
+		err := d.QueryRow("select 1 from pragma_table_info(?) where name = ?", m.table, m.column).Scan(&found)
+		if err == sql.ErrNoRows {
+			_, err = d.Exec(fmt.Sprintf("alter table %s add column %s %s", m.table, m.column, m.decl))
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = d.Exec(fmt.Sprintf("pragma user_version = %d", version+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *sqlDAO) prepare() error {
 	if _, err := d.Exec(sqlSchema); err != nil {
 		return err
 	}
+	if err := d.migrate(); err != nil {
+		return err
+	}
 	t := reflect.TypeOf(&d.prepared).Elem()
 	v := reflect.ValueOf(&d.prepared).Elem()
 	for i := 0; i < t.NumField(); i++ {
@@ -154,7 +490,7 @@ func (d *sqlDAO) NewUser(login string, email string, password []byte) (*UserData
 	if err == nil {
 		_, err = d.prepared.NewStream.Exec(uid)
 	}
-	return &UserData{uid, login, email, login, hash, "", false, actoken, sectoken}, err
+	return &UserData{uid, login, email, login, hash, "", false, actoken, sectoken, ""}, err
 }
 
 func (d *sqlDAO) ResetUser(login string, orEmail string) (uid int64, token string, err error) {
@@ -209,10 +545,10 @@ func (d *sqlDAO) GetUserID(login string, password []byte) (int64, error) {
 }
 
 func (d *sqlDAO) GetUserFull(id int64) (*UserData, error) {
-	var actoken sql.NullString
+	var actoken, apitoken sql.NullString
 	u := UserData{ID: id}
 	err := d.prepared.GetUserInfo.QueryRow(id).Scan(
-		&u.Name, &u.Login, &u.Email, &u.PwHash, &u.About, &actoken, &u.StreamToken,
+		&u.Name, &u.Login, &u.Email, &u.PwHash, &u.About, &actoken, &u.StreamToken, &apitoken,
 	)
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotExist
@@ -220,6 +556,7 @@ func (d *sqlDAO) GetUserFull(id int64) (*UserData, error) {
 	if u.Activated = !actoken.Valid; actoken.Valid {
 		u.ActivationToken = actoken.String
 	}
+	u.APIToken = apitoken.String
 	return &u, err
 }
 
@@ -266,7 +603,7 @@ func (d *sqlDAO) SetUserData(id int64, name string, login string, email string,
 	params = append(params, about, id)
 
 	if offlineOnly {
-		query += " and not exists(select 1 from streams where user = users.id and server is not null)"
+		query += " and not exists(select 1 from streams where user = users.id and instance in (select instance from nodes where expires > datetime('now')))"
 	}
 	r, err := d.Exec(query, params...)
 	if err != nil {
@@ -287,13 +624,37 @@ func errOf(_ interface{}, err error) error {
 }
 
 func (d *sqlDAO) NewStreamToken(id int64) error {
-	// TODO invalidate token cache on all nodes
-	//      damn, it appears I ran into the most difficult problem...
-	return errOf(d.prepared.SetStreamToken.Exec(makeToken(tokenLength), id))
+	// Servers that have the old token cached will drop it after the next heartbeat.
+	// Active broadcasts recheck their tokens every few seconds, so they will stop too.
+	if _, err := d.prepared.SetStreamToken.Exec(makeToken(tokenLength), id); err != nil {
+		return err
+	}
+	d.refreshTokens()
+	return nil
+}
+
+func (d *sqlDAO) NewAPIToken(id int64) error {
+	return errOf(d.prepared.SetAPIToken.Exec(id, makeToken(tokenLength)))
 }
 
-func (d *sqlDAO) SetStreamName(id int64, name string, nsfw bool) error {
-	return errOf(d.prepared.SetStreamName.Exec(name, nsfw, id))
+func (d *sqlDAO) DelAPIToken(id int64) error {
+	return errOf(d.prepared.DelAPIToken.Exec(id))
+}
+
+func (d *sqlDAO) GetUserByAPIToken(token string) (*UserData, error) {
+	var uid int64
+	err := d.prepared.GetAPITokenUser.QueryRow(token).Scan(&uid)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.GetUserFull(uid)
+}
+
+func (d *sqlDAO) SetStreamName(id int64, name string, nsfw bool, paced bool, captions bool) error {
+	return errOf(d.prepared.SetStreamName.Exec(name, nsfw, paced, captions, id))
 }
 
 func (d *sqlDAO) AddStreamPanel(id int64, text string) error {
@@ -308,6 +669,13 @@ func (d *sqlDAO) DelStreamPanel(id int64, n int64) error {
 	return errOf(d.prepared.DelStreamPanel.Exec(id, n))
 }
 
+func (d *sqlDAO) SetStreamSlate(id int64, data []byte) error {
+	if len(data) == 0 {
+		data = nil
+	}
+	return errOf(d.prepared.SetStreamSlate.Exec(data, id))
+}
+
 func (d *sqlDAO) StartStream(id string, token string) error {
 	d.streamTokenLock.RLock()
 	if expect, ok := d.streamTokens[id]; ok {
@@ -319,16 +687,19 @@ func (d *sqlDAO) StartStream(id string, token string) error {
 	}
 	d.streamTokenLock.RUnlock()
 
-	_, err := d.prepared.SetStreamServer.Exec(d.localhost, id, token)
+	// A claim held by a live process stays there, even if that process has the same
+	// address; it may be one this process has replaced that is still serving the stream.
+	// The chat room follows the stream; see `GetRoomServer`.
+	_, err := d.prepared.SetStreamServer.Exec(d.localhost, d.instance, d.localhost, d.instance, id, token)
 	if err != nil {
 		return err
 	}
 
 	var expect string
-	var server sql.NullString
+	var server, owner sql.NullString
 	var activated = true
 
-	err = d.prepared.GetStreamAuth.QueryRow(id).Scan(&server, &expect, &activated)
+	err = d.prepared.GetStreamAuth.QueryRow(id).Scan(&server, &owner, &expect, &activated)
 	if err == sql.ErrNoRows {
 		return ErrStreamNotExist
 	}
@@ -338,7 +709,11 @@ func (d *sqlDAO) StartStream(id string, token string) error {
 	if expect != token || !activated {
 		return ErrInvalidToken
 	}
-	if !server.Valid || server.String != d.localhost {
+	if !owner.Valid || owner.String != d.instance {
+		if server.String == d.localhost {
+			// It will be released once the previous process is done with it.
+			return ErrStreamHandover
+		}
 		return ErrStreamNotHere
 	}
 	d.streamTokenLock.Lock()
@@ -351,7 +726,11 @@ func (d *sqlDAO) StopStream(id string) error {
 	d.streamTokenLock.Lock()
 	delete(d.streamTokens, id)
 	d.streamTokenLock.Unlock()
-	_, err := d.prepared.DelStreamServer.Exec(id)
+	// The stream may have already moved to another node (see `Drain`).
+	_, err := d.prepared.DelStreamServer.Exec(d.instance, id)
+	if err == nil {
+		_, err = d.prepared.StopSession.Exec(d.instance, id)
+	}
 	return err
 }
 
@@ -363,8 +742,9 @@ func (d *sqlDAO) GetStreamServer(id string) (string, error) {
 	}
 	d.streamTokenLock.RUnlock()
 
-	var server sql.NullString
-	err := d.prepared.GetStreamServer.QueryRow(id).Scan(&server)
+	var server, owner sql.NullString
+	var alive sql.NullBool
+	err := d.prepared.GetStreamServer.QueryRow(id).Scan(&server, &owner, &alive)
 	if err == sql.ErrNoRows {
 		return "", ErrStreamNotExist
 	}
@@ -374,10 +754,17 @@ func (d *sqlDAO) GetStreamServer(id string) (string, error) {
 	if !server.Valid {
 		return "", ErrStreamOffline
 	}
-	if server.String != d.localhost {
-		return server.String, ErrStreamNotHere
+	if alive.Bool && owner.String != d.instance {
+		if server.String != d.localhost {
+			return server.String, ErrStreamNotHere
+		}
+		// The process this one has replaced still has it, but no longer accepts
+		// connections. The broadcaster will reconnect here once it is done.
+		return "", ErrStreamOffline
 	}
-	if _, err = d.prepared.DelStreamServer.Exec(id); err != nil {
+	// Either this process has forgotten about the stream, or the one that
+	// claimed it is dead. Either way, the stream is not actually online.
+	if _, err = d.prepared.DelStreamServer.Exec(owner, id); err != nil {
 		return "", err
 	}
 	return "", ErrStreamOffline
@@ -386,10 +773,11 @@ func (d *sqlDAO) GetStreamServer(id string) (string, error) {
 func (d *sqlDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	var intId int
 	var server sql.NullString
+	var tags []byte
 	meta := StreamMetadata{}
 	err := d.prepared.GetStreamInfo.QueryRow(id).Scan(
 		&meta.OwnerID, &meta.UserName, &meta.UserAbout, &meta.Email, &meta.Name, &server,
-		&meta.HasVideo, &meta.HasAudio, &meta.Width, &meta.Height, &meta.NSFW, &intId,
+		&meta.HasVideo, &meta.HasAudio, &meta.Width, &meta.Height, &meta.NSFW, &meta.Paced, &meta.Captions, &tags, &intId,
 	)
 	if err == sql.ErrNoRows {
 		return nil, ErrStreamNotExist
@@ -397,6 +785,9 @@ func (d *sqlDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = json.Unmarshal(tags, &meta.Tags); err != nil {
+		return nil, err
+	}
 	rows, err := d.prepared.GetStreamPanels.Query(intId)
 	if err == nil {
 		meta.Panels, err = d.loadPanelsFromRows(rows)
@@ -422,6 +813,23 @@ func (d *sqlDAO) SetStreamTrackInfo(id string, info *StreamTrackInfo) error {
 	return errOf(d.prepared.SetStreamTracks.Exec(info.HasVideo, info.HasAudio, info.Width, info.Height, id))
 }
 
+func (d *sqlDAO) SetStreamTags(id string, tags map[string]string) error {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return errOf(d.prepared.SetStreamTags.Exec(string(data), id))
+}
+
+func (d *sqlDAO) GetStreamSlate(id string) ([]byte, error) {
+	var data []byte
+	err := d.prepared.GetStreamSlate.QueryRow(id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrStreamNotExist
+	}
+	return data, err
+}
+
 func (d *sqlDAO) GetRecordings(id string) (*StreamHistory, error) {
 	h := StreamHistory{}
 	err := d.prepared.GetRecordings1.QueryRow(id).Scan(&h.OwnerID, &h.UserName, &h.UserAbout, &h.Email, &h.SpaceLimit)
@@ -446,10 +854,11 @@ func (d *sqlDAO) GetRecordings(id string) (*StreamHistory, error) {
 
 func (d *sqlDAO) GetRecording(id string, recid int64) (*StreamRecording, error) {
 	var intId int
+	var session int64
 	r := StreamRecording{}
 	err := d.prepared.GetRecording.QueryRow(recid).Scan(
 		&r.OwnerID, &r.UserName, &r.UserAbout, &r.Email, &r.Name, &r.Server, &r.HasVideo,
-		&r.HasAudio, &r.Width, &r.Height, &r.NSFW, &r.Path, &r.Space, &r.Timestamp, &intId,
+		&r.HasAudio, &r.Width, &r.Height, &r.NSFW, &r.Path, &r.Space, &r.Timestamp, &intId, &session,
 	)
 	if err == sql.ErrNoRows {
 		return nil, ErrStreamNotExist
@@ -461,13 +870,476 @@ func (d *sqlDAO) GetRecording(id string, recid int64) (*StreamRecording, error)
 	if err == nil {
 		r.Panels, err = d.loadPanelsFromRows(rows)
 	}
+	if err == nil {
+		r.Markers, err = d.GetStreamMarkers(session)
+	}
+	if err == nil {
+		r.Polls, err = d.GetStreamPolls(session)
+	}
+	r.Session = session
 	return &r, err
 }
 
-func (d *sqlDAO) StartRecording(id string, filename string) (recid int64, sizeLimit int64, e error) {
-	return 0, 0, nil
+func (d *sqlDAO) SetNodeLoad(load NodeLoad) error {
+	return errOf(d.prepared.SetNodeLoad.Exec(load.Ingests, load.Viewers, load.Egress, load.Draining, d.instance))
 }
 
-func (d *sqlDAO) StopRecording(id string, recid int64, size int64) error {
+func (d *sqlDAO) GetIdlestNode() (string, *NodeLoad, error) {
+	var server string
+	load := NodeLoad{}
+	err := d.prepared.GetIdlestNode.QueryRow(d.localhost).Scan(&server, &load.Ingests, &load.Viewers, &load.Egress)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrStreamNotExist
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return server, &load, nil
+}
+
+func (d *sqlDAO) GetRoomServer(id string) (string, error) {
+	if _, err := d.prepared.SetRoomServer.Exec(d.localhost, id); err != nil {
+		return "", err
+	}
+	var server sql.NullString
+	err := d.prepared.GetRoomServer.QueryRow(id).Scan(&server)
+	if err == sql.ErrNoRows {
+		return "", ErrStreamNotExist
+	}
+	if err != nil {
+		return "", err
+	}
+	if server.String != d.localhost {
+		return server.String, ErrStreamNotHere
+	}
+	return server.String, nil
+}
+
+func (d *sqlDAO) SetRelayViewers(id string, viewers int) error {
+	return errOf(d.prepared.SetRelayViewers.Exec(d.localhost, viewers, id))
+}
+
+func (d *sqlDAO) GetRelayViewers(id string) (int, error) {
+	viewers := 0
+	err := d.prepared.GetRelayViewers.QueryRow(id).Scan(&viewers)
+	return viewers, err
+}
+
+func (d *sqlDAO) SetSessionViewers(session int64, viewers int) error {
+	return errOf(d.prepared.SetPeakViewers.Exec(viewers, session))
+}
+
+func (d *sqlDAO) StartSession(id string) (int64, error) {
+	r, err := d.prepared.StartSession.Exec(d.localhost, d.instance, id)
+	if err != nil {
+		return 0, err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows != 1 {
+		return 0, ErrStreamNotExist
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) AddStreamMarker(session int64, timecode uint64, label string) error {
+	return errOf(d.prepared.AddMarker.Exec(session, timecode, label))
+}
+
+func (d *sqlDAO) GetStreamMarkers(session int64) ([]StreamMarker, error) {
+	rows, err := d.prepared.GetMarkers.Query(session)
+	if err != nil {
+		return nil, err
+	}
+	r := []StreamMarker{}
+	marker := StreamMarker{}
+	for rows.Next() && rows.Scan(&marker.Timecode, &marker.Label) == nil {
+		r = append(r, marker)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
+// Options are stored one per line.
+func (d *sqlDAO) AddChatPoll(id string, question string, options []string, seconds int) (int64, error) {
+	r, err := d.prepared.AddChatPoll.Exec(question, strings.Join(options, "\n"), seconds, id)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return 0, ErrPollActive
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) EndChatPoll(id string) error {
+	r, err := d.prepared.EndChatPoll.Exec(id)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return ErrPollNotExist
+	}
+	return nil
+}
+
+func (d *sqlDAO) GetChatPoll(id string) (*StreamPoll, error) {
+	rows, err := d.prepared.GetChatPoll.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	polls, err := d.loadPollsFromRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(polls) == 0 {
+		return nil, ErrPollNotExist
+	}
+	return &polls[0], nil
+}
+
+func (d *sqlDAO) GetStreamPolls(session int64) ([]StreamPoll, error) {
+	rows, err := d.prepared.GetSessionPolls.Query(session)
+	if err != nil {
+		return nil, err
+	}
+	return d.loadPollsFromRows(rows)
+}
+
+func (d *sqlDAO) loadPollsFromRows(rows *sql.Rows) ([]StreamPoll, error) {
+	r := []StreamPoll{}
+	poll := StreamPoll{}
+	options := ""
+	for rows.Next() && rows.Scan(&poll.ID, &poll.Question, &options, &poll.Ends, &poll.Open) == nil {
+		poll.Options = nil
+		for _, text := range strings.Split(options, "\n") {
+			poll.Options = append(poll.Options, StreamPollOption{Text: text})
+		}
+		r = append(r, poll)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range r {
+		votes, err := d.prepared.GetPollVotes.Query(r[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		var option, count int
+		for votes.Next() && votes.Scan(&option, &count) == nil {
+			if option >= 0 && option < len(r[i].Options) {
+				r[i].Options[option].Votes = count
+			}
+		}
+		votes.Close()
+		if err := votes.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (d *sqlDAO) AddChatVote(pollid int64, option int, login string, anon string) error {
+	r, err := d.prepared.AddChatVote.Exec(option, login, anon, pollid, login, login, login, anon)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return ErrAlreadyVoted
+	}
+	return nil
+}
+
+func (d *sqlDAO) GetChatFilters(id string) (*ChatFilters, error) {
+	f := ChatFilters{}
+	err := d.prepared.GetChatFilters.QueryRow(id).Scan(&f.Links, &f.LinkAction, &f.MaxCaps, &f.CapsAction)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	rows, err := d.prepared.GetFilterRules.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	rule := ChatFilterRule{}
+	for rows.Next() && rows.Scan(&rule.ID, &rule.Pattern, &rule.Regex, &rule.Action) == nil {
+		f.Rules = append(f.Rules, rule)
+	}
+	rows.Close()
+	return &f, rows.Err()
+}
+
+func (d *sqlDAO) AddChatFilterRule(id string, rule ChatFilterRule) (int64, error) {
+	r, err := d.prepared.AddFilterRule.Exec(rule.Pattern, rule.Regex, rule.Action, id)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return 0, ErrStreamNotExist
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) DelChatFilterRule(id string, ruleid int64) error {
+	r, err := d.prepared.DelFilterRule.Exec(ruleid, id)
+	if err != nil {
+		return err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return ErrFilterNotExist
+	}
 	return nil
 }
+
+func (d *sqlDAO) SetChatLinkPolicy(id string, policy ChatLinkPolicy, action ChatFilterAction) error {
+	return errOf(d.prepared.SetLinkPolicy.Exec(policy, action, id))
+}
+
+func (d *sqlDAO) SetChatCapsLimit(id string, percent int, action ChatFilterAction) error {
+	return errOf(d.prepared.SetCapsLimit.Exec(percent, action, id))
+}
+
+func (d *sqlDAO) AddHeldMessage(id string, msg *StreamChatMessage, reason string) (int64, error) {
+	r, err := d.prepared.AddHeldMessage.Exec(msg.Name, msg.Login, msg.Anon, msg.Text, msg.Action, msg.Bot, reason, id)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return 0, ErrStreamNotExist
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) GetHeldMessages(id string) ([]StreamHeldMessage, error) {
+	rows, err := d.prepared.GetHeldMessages.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	r := []StreamHeldMessage{}
+	msg := StreamHeldMessage{}
+	for rows.Next() && rows.Scan(&msg.ID, &msg.Name, &msg.Login, &msg.Anon, &msg.Text, &msg.Action, &msg.Bot, &msg.Timestamp, &msg.Reason) == nil {
+		r = append(r, msg)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
+func (d *sqlDAO) TakeHeldMessage(id string, heldid int64) (*StreamHeldMessage, error) {
+	msg := StreamHeldMessage{}
+	err := d.prepared.GetHeldMessage.QueryRow(heldid, id).Scan(
+		&msg.ID, &msg.Name, &msg.Login, &msg.Anon, &msg.Text, &msg.Action, &msg.Bot, &msg.Timestamp, &msg.Reason,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := d.prepared.DelHeldMessage.Exec(heldid)
+	if err != nil {
+		return nil, err
+	}
+	// Another moderator may have been quicker.
+	if n, err := r.RowsAffected(); err != nil || n != 1 {
+		return nil, ErrMessageNotExist
+	}
+	return &msg, nil
+}
+
+func (d *sqlDAO) AddChatMessage(id string, session int64, msg *StreamChatMessage) (int64, error) {
+	r, err := d.prepared.AddChatMessage.Exec(session, msg.Name, msg.Login, msg.Anon, msg.Text, msg.Action, msg.Bot, id)
+	if err != nil {
+		return 0, err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows != 1 {
+		return 0, ErrStreamNotExist
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) GetChatReplay(session int64) ([]StreamChatMessage, error) {
+	rows, err := d.prepared.GetChatReplay.Query(session)
+	if err != nil {
+		return nil, err
+	}
+	r := []StreamChatMessage{}
+	msg := StreamChatMessage{}
+	for rows.Next() && rows.Scan(&msg.ID, &msg.Name, &msg.Login, &msg.Anon, &msg.Text, &msg.Action, &msg.Bot, &msg.Timestamp) == nil {
+		r = append(r, msg)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
+func (d *sqlDAO) GetChatHistory(id string, before int64, limit int) ([]StreamChatMessage, error) {
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	rows, err := d.prepared.GetChatHistory.Query(before, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	r := []StreamChatMessage{}
+	msg := StreamChatMessage{}
+	for rows.Next() && rows.Scan(&msg.ID, &msg.Name, &msg.Login, &msg.Anon, &msg.Text, &msg.Action, &msg.Bot, &msg.Timestamp) == nil {
+		r = append(r, msg)
+	}
+	rows.Close()
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return r, rows.Err()
+}
+
+func (d *sqlDAO) ClearChatHistory(id string) error {
+	_, err := d.prepared.ClearChat.Exec(id)
+	return err
+}
+
+func (d *sqlDAO) DelChatMessage(id string, msgid int64) error {
+	r, err := d.prepared.DelChatMessage.Exec(msgid, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows != 1 {
+		return ErrMessageNotExist
+	}
+	return nil
+}
+
+func (d *sqlDAO) GetChatRole(id string, login string) (ChatRole, error) {
+	var role ChatRole
+	err := d.prepared.GetChatRole.QueryRow(id, login).Scan(&role)
+	if err == sql.ErrNoRows {
+		return ChatUser, nil
+	}
+	return role, err
+}
+
+func (d *sqlDAO) GetChatAnonRole(id string, anon string) (ChatRole, error) {
+	var role ChatRole
+	err := d.prepared.GetAnonRole.QueryRow(id, anon, anon, anon).Scan(&role)
+	return role, err
+}
+
+func (d *sqlDAO) AddChatModerator(id string, login string) error {
+	if err := errOf(d.prepared.AddModerator.Exec(id, login)); err != nil {
+		return err
+	}
+	// Nothing is inserted if there is no such user (or if they already are a moderator).
+	role, err := d.GetChatRole(id, login)
+	if err == nil && role == ChatUser {
+		return ErrUserNotExist
+	}
+	return err
+}
+
+func (d *sqlDAO) DelChatModerator(id string, login string) error {
+	return errOf(d.prepared.DelModerator.Exec(id, login))
+}
+
+func (d *sqlDAO) AddChatBan(id string, login string, anon string, seconds int) error {
+	return errOf(d.prepared.AddChatBan.Exec(login, anon, seconds, seconds, id))
+}
+
+func (d *sqlDAO) DelChatBan(id string, login string, anon string) error {
+	return errOf(d.prepared.DelChatBan.Exec(id, login, anon))
+}
+
+func (d *sqlDAO) GetChatBan(id string, login string, anon string) (bool, time.Time, error) {
+	var until sql.NullTime
+	err := d.prepared.GetChatBan.QueryRow(id, login, anon).Scan(&until)
+	if err == sql.ErrNoRows {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return true, until.Time, nil
+}
+
+func (d *sqlDAO) ClaimChatName(id string, name string, login string, anon string) (int64, error) {
+	r, err := d.prepared.ClaimChatName.Exec(name, login, anon, d.instance, id, name, login, name, login, login, login, anon)
+	if err != nil {
+		return 0, err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows != 1 {
+		return 0, ErrUserNotUnique
+	}
+	return r.LastInsertId()
+}
+
+func (d *sqlDAO) ReleaseChatName(claim int64) error {
+	return errOf(d.prepared.FreeChatName.Exec(claim))
+}
+
+func (d *sqlDAO) GetChatNameOwner(id string, name string) (string, string, error) {
+	var login, anon string
+	err := d.prepared.GetNameOwner.QueryRow(id, name).Scan(&login, &anon)
+	if err == sql.ErrNoRows {
+		return "", "", ErrUserNotExist
+	}
+	return login, anon, err
+}
+
+func (d *sqlDAO) AddChatBlock(login string, anon string, name string, blockedLogin string, blockedAnon string) error {
+	return errOf(d.prepared.AddChatBlock.Exec(login, anon, name, blockedLogin, blockedAnon))
+}
+
+func (d *sqlDAO) DelChatBlock(login string, anon string, name string) error {
+	return errOf(d.prepared.DelChatBlock.Exec(login, login, login, anon, name))
+}
+
+func (d *sqlDAO) IsChatUserBlocked(login string, anon string, byLogin string, byAnon string) (bool, error) {
+	var found int
+	err := d.prepared.IsChatBlocked.QueryRow(login, login, login, anon, byLogin, byAnon).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *sqlDAO) SetChatCommand(id string, name string, text string) error {
+	if text == "" {
+		return errOf(d.prepared.DelChatCommand.Exec(name, id))
+	}
+	return errOf(d.prepared.SetChatCommand.Exec(name, text, id))
+}
+
+func (d *sqlDAO) GetChatCommand(id string, name string) (string, error) {
+	var text string
+	err := d.prepared.GetChatCommand.QueryRow(name, id).Scan(&text)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return text, err
+}
+
+func (d *sqlDAO) SetChatSlowMode(id string, seconds int) error {
+	return errOf(d.prepared.SetSlowMode.Exec(seconds, id))
+}
+
+func (d *sqlDAO) GetChatSlowMode(id string) (int, error) {
+	var seconds int
+	err := d.prepared.GetSlowMode.QueryRow(id).Scan(&seconds)
+	if err == sql.ErrNoRows {
+		return 0, ErrStreamNotExist
+	}
+	return seconds, err
+}
+
+func (d *sqlDAO) StartRecording(id string, session int64, filename string) (recid int64, sizeLimit int64, e error) {
+	if e = d.prepared.GetSpaceLeft.QueryRow(id).Scan(&sizeLimit); e == sql.ErrNoRows {
+		return 0, 0, ErrStreamNotExist
+	}
+	if e != nil || sizeLimit <= 0 {
+		return 0, 0, e
+	}
+	r, e := d.prepared.StartRecording.Exec(session, d.localhost, filename, id)
+	if e == nil {
+		recid, e = r.LastInsertId()
+	}
+	return recid, sizeLimit, e
+}
+
+func (d *sqlDAO) StopRecording(id string, recid int64, size int64) error {
+	return errOf(d.prepared.StopRecording.Exec(size, recid))
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"testing"
+)
+
+func testSQLDatabase(t *testing.T, localhost string, path string) *sqlDAO {
+	db, err := NewSQLDatabase(localhost, "sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db.(*sqlDAO)
+}
+
+// Make a user whose stream can be started with the token "token".
+func testSQLStreamer(t *testing.T, db *sqlDAO, login string) int64 {
+	user, err := db.NewUser(login, login+"@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("update users set actoken = null, sectoken = 'token' where id = ?", user.ID); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+func TestSQLLease(t *testing.T) {
+	path := t.TempDir() + "/leases.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	testSQLStreamer(t, a, "alice")
+	if err := a.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := b.GetStreamServer("alice"); err != ErrStreamNotHere || server != "a:8000" {
+		t.Fatalf("expected the stream to be on a:8000, got %q, %v", server, err)
+	}
+	if err := b.StartStream("alice", "token"); err != ErrStreamNotHere {
+		t.Fatalf("claimed a stream owned by a live server: %v", err)
+	}
+	// Server A stops renewing its lease, so B can take over.
+	if _, err := a.Exec("update nodes set expires = datetime('now', '-1 second') where server = 'a:8000'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetStreamServer("alice"); err != ErrStreamOffline {
+		t.Fatalf("a stream on a dead server should be offline, got %v", err)
+	}
+	if err := b.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := b.GetStreamServer("alice"); err != nil || server != "b:8000" {
+		t.Fatalf("expected the stream to be on b:8000, got %q, %v", server, err)
+	}
+}
+
+func TestSQLStreamTokenRevoked(t *testing.T) {
+	path := t.TempDir() + "/tokens.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	id := testSQLStreamer(t, a, "alice")
+	if err := a.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	// The owner asks a different server for a new token.
+	if err := b.NewStreamToken(id); err != nil {
+		t.Fatal(err)
+	}
+	a.refreshTokens()
+	if err := a.StartStream("alice", "token"); err != ErrInvalidToken {
+		t.Fatalf("the old token still works: %v", err)
+	}
+}
+
+func TestSQLLeaseHandover(t *testing.T) {
+	path := t.TempDir() + "/handover.db"
+	old := testSQLDatabase(t, "a:8000", path)
+	testSQLStreamer(t, old, "alice")
+	if err := old.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	// The process that replaces it on SIGUSR2 has the same address.
+	new := testSQLDatabase(t, "a:8000", path)
+	if err := new.StartStream("alice", "token"); err != ErrStreamHandover {
+		t.Fatalf("took over a stream from a live process: %v", err)
+	}
+	if _, err := new.GetStreamServer("alice"); err != ErrStreamOffline {
+		t.Fatalf("expected the stream to be offline, got %v", err)
+	}
+	if err := old.StopStream("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := new.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := new.GetStreamServer("alice"); err != nil || server != "a:8000" {
+		t.Fatalf("expected the stream to be here, got %q, %v", server, err)
+	}
+}
+
+func TestSQLRoomServer(t *testing.T) {
+	path := t.TempDir() + "/rooms.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	testSQLStreamer(t, a, "alice")
+	// The first node to open the chat of an offline stream keeps it.
+	if server, err := a.GetRoomServer("alice"); err != nil || server != "a:8000" {
+		t.Fatalf("expected the room to be on a:8000, got %q, %v", server, err)
+	}
+	if server, err := b.GetRoomServer("alice"); err != ErrStreamNotHere || server != "a:8000" {
+		t.Fatalf("expected the room to stay on a:8000, got %q, %v", server, err)
+	}
+	// Then it moves to wherever the stream goes live.
+	if err := b.StartStream("alice", "token"); err != nil {
+		t.Fatal(err)
+	}
+	if server, err := a.GetRoomServer("alice"); err != ErrStreamNotHere || server != "b:8000" {
+		t.Fatalf("expected the room to follow the stream to b:8000, got %q, %v", server, err)
+	}
+	if _, err := a.GetRoomServer("bob"); err != ErrStreamNotExist {
+		t.Fatalf("expected a nonexistent stream, got %v", err)
+	}
+}
+
+func TestSQLChatReplay(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/replay.db")
+	testSQLStreamer(t, db, "alice")
+	session, err := db.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []struct {
+		session int64
+		text    string
+	}{{0, "before"}, {session, "first"}, {session, "second"}, {0, "after"}} {
+		if _, err := db.AddChatMessage("alice", msg.session, &StreamChatMessage{Name: "Bob", Login: "bob", Text: msg.text}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := db.GetChatReplay(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].Text != "first" || messages[1].Text != "second" {
+		t.Fatalf("expected the messages of the session in order, got %+v", messages)
+	}
+	if messages[0].Name != "Bob" || messages[0].Login != "bob" {
+		t.Fatalf("expected the author to be saved, got %+v", messages[0])
+	}
+}
+
+func TestSQLChatHistory(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/history.db")
+	testSQLStreamer(t, db, "alice")
+	testSQLStreamer(t, db, "carol")
+	ids := []int64{}
+	for _, text := range []string{"one", "two", "three", "four"} {
+		id, err := db.AddChatMessage("alice", 0, &StreamChatMessage{Name: "Bob", Login: "bob", Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := db.AddChatMessage("carol", 0, &StreamChatMessage{Name: "Bob", Login: "bob", Text: "elsewhere"}); err != nil {
+		t.Fatal(err)
+	}
+	texts := func(messages []StreamChatMessage) (r []string) {
+		for _, msg := range messages {
+			r = append(r, msg.Text)
+		}
+		return r
+	}
+	latest, err := db.GetChatHistory("alice", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := texts(latest); len(r) != 2 || r[0] != "three" || r[1] != "four" {
+		t.Fatalf("expected the latest messages, oldest first, got %v", r)
+	}
+	older, err := db.GetChatHistory("alice", latest[0].ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := texts(older); len(r) != 2 || r[0] != "one" || r[1] != "two" || older[0].ID != ids[0] {
+		t.Fatalf("expected the messages before %d, got %v", latest[0].ID, r)
+	}
+}
+
+func TestSQLChatModeration(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/moderation.db")
+	testSQLStreamer(t, db, "alice")
+	testSQLStreamer(t, db, "bob")
+	if role, err := db.GetChatRole("alice", "alice"); err != nil || role != ChatOwner {
+		t.Fatalf("expected the owner, got %v, %v", role, err)
+	}
+	if err := db.AddChatModerator("alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := db.GetChatRole("alice", "bob"); err != nil || role != ChatModerator {
+		t.Fatalf("expected a moderator, got %v, %v", role, err)
+	}
+	if err := db.AddChatModerator("alice", "nobody"); err != ErrUserNotExist {
+		t.Fatalf("expected a nonexistent user, got %v", err)
+	}
+	// An anonymous session can be banned without a login, and the other way around.
+	if err := db.AddChatBan("alice", "", "session", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddChatBan("alice", "carol", "", 60); err != nil {
+		t.Fatal(err)
+	}
+	if banned, until, err := db.GetChatBan("alice", "", "session"); err != nil || !banned || !until.IsZero() {
+		t.Fatalf("expected a permanent ban, got %v until %v, %v", banned, until, err)
+	}
+	if banned, until, err := db.GetChatBan("alice", "carol", "other"); err != nil || !banned || until.IsZero() {
+		t.Fatalf("expected a timeout, got %v until %v, %v", banned, until, err)
+	}
+	if banned, _, err := db.GetChatBan("bob", "carol", "session"); err != nil || banned {
+		t.Fatalf("a ban applies to other streams: %v", err)
+	}
+	if err := db.DelChatBan("alice", "carol", ""); err != nil {
+		t.Fatal(err)
+	}
+	if banned, _, err := db.GetChatBan("alice", "carol", ""); err != nil || banned {
+		t.Fatalf("expected the timeout to be lifted, got %v, %v", banned, err)
+	}
+}
+
+func TestSQLChatAnonRole(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/anonrole.db")
+	testSQLStreamer(t, db, "alice")
+	testSQLStreamer(t, db, "bob")
+	if err := db.AddChatModerator("alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddChatMessage("alice", 0, &StreamChatMessage{Name: "Bob", Login: "bob", Anon: "bobs-session", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddChatMessage("alice", 0, &StreamChatMessage{Name: "Guest", Anon: "guest-session", Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := db.GetChatAnonRole("alice", "bobs-session"); err != nil || role != ChatModerator {
+		t.Fatalf("expected the session of a moderator, got %v, %v", role, err)
+	}
+	if role, err := db.GetChatAnonRole("alice", "guest-session"); err != nil || role != ChatUser {
+		t.Fatalf("expected the session of a user, got %v, %v", role, err)
+	}
+}
+
+func TestSQLChatNames(t *testing.T) {
+	path := t.TempDir() + "/names.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	testSQLStreamer(t, a, "alice")
+	testSQLStreamer(t, a, "bob")
+	claim, err := a.ClaimChatName("alice", "Guest", "", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.ClaimChatName("alice", "guest", "", "second"); err != ErrUserNotUnique {
+		t.Fatalf("claimed a name taken on another node: %v", err)
+	}
+	// Another tab of the same session is fine.
+	if _, err := b.ClaimChatName("alice", "Guest", "", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ClaimChatName("bob", "Guest", "", "second"); err != nil {
+		t.Fatalf("names should only be unique within a room: %v", err)
+	}
+	if _, err := a.ClaimChatName("alice", "Bob", "", "second"); err != ErrUserNotUnique {
+		t.Fatalf("claimed someone's login: %v", err)
+	}
+	if _, err := a.ClaimChatName("alice", "Bob", "bob", "third"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ReleaseChatName(claim); err != nil {
+		t.Fatal(err)
+	}
+	// The session still has a claim through B; once B is gone, so is the claim.
+	if _, err := a.ClaimChatName("alice", "Guest", "", "second"); err != ErrUserNotUnique {
+		t.Fatalf("claimed a name still taken on another node: %v", err)
+	}
+	if _, err := a.Exec("update nodes set expires = datetime('now', '-1 second') where server = 'b:8000'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ClaimChatName("alice", "Guest", "", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := a.GetChatAnonRole("alice", "third"); err != nil || role != ChatUser {
+		t.Fatalf("expected a user, got %v, %v", role, err)
+	}
+	if err := a.AddChatModerator("alice", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := a.GetChatAnonRole("alice", "third"); err != nil || role != ChatModerator {
+		t.Fatalf("expected the session bob has chatted from to be a moderator's, got %v, %v", role, err)
+	}
+}
+
+func TestSQLChatClear(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/clear.db")
+	testSQLStreamer(t, db, "alice")
+	session, err := db.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddChatMessage("alice", session, &StreamChatMessage{Name: "Bob", Text: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ClearChatHistory("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AddChatMessage("alice", session, &StreamChatMessage{Name: "Bob", Text: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := db.GetChatHistory("alice", 0, 10); err != nil || len(history) != 1 || history[0].Text != "after" {
+		t.Fatalf("expected only the message sent after clearing, got %+v, %v", history, err)
+	}
+	if replay, err := db.GetChatReplay(session); err != nil || len(replay) != 2 {
+		t.Fatalf("expected the replay to keep both messages, got %+v, %v", replay, err)
+	}
+}
+
+func TestSQLChatBlocks(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/blocks.db")
+	// Alice blocks whoever was called "Troll", which was an anonymous session.
+	if err := db.AddChatBlock("alice", "alices-session", "Troll", "", "trolls-session"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := db.IsChatUserBlocked("alice", "another-session", "", "trolls-session"); err != nil || !blocked {
+		t.Fatalf("expected the block to apply to every session of alice, got %v, %v", blocked, err)
+	}
+	if blocked, err := db.IsChatUserBlocked("", "trolls-session", "alice", "alices-session"); err != nil || blocked {
+		t.Fatalf("blocks should only go one way, got %v, %v", blocked, err)
+	}
+	if blocked, err := db.IsChatUserBlocked("", "alices-session", "", "trolls-session"); err != nil || blocked {
+		t.Fatalf("a block by a logged in user applied to an anonymous session, got %v, %v", blocked, err)
+	}
+	if err := db.DelChatBlock("alice", "", "troll"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := db.IsChatUserBlocked("alice", "alices-session", "", "trolls-session"); err != nil || blocked {
+		t.Fatalf("expected the block to be removed, got %v, %v", blocked, err)
+	}
+}
+
+func TestSQLAPIToken(t *testing.T) {
+	db := testSQLDatabase(t, "a:8000", t.TempDir()+"/apitokens.db")
+	uid := testSQLStreamer(t, db, "bot")
+	if err := db.NewAPIToken(uid); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.GetUserFull(uid)
+	if err != nil || user.APIToken == "" {
+		t.Fatalf("expected a token, got %+v, %v", user, err)
+	}
+	old := user.APIToken
+	if user, err = db.GetUserByAPIToken(old); err != nil || user.Login != "bot" {
+		t.Fatalf("expected the token to log in as bot, got %+v, %v", user, err)
+	}
+	// Making a new token revokes the old one.
+	if err := db.NewAPIToken(uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserByAPIToken(old); err != ErrInvalidToken {
+		t.Fatalf("expected the old token to be revoked, got %v", err)
+	}
+	if err := db.DelAPIToken(uid); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = db.GetUserFull(uid); err != nil || user.APIToken != "" {
+		t.Fatalf("expected no token after deleting it, got %+v, %v", user, err)
+	}
+	// Messages sent by bots are marked as such even after reloading them.
+	if _, err := db.AddChatMessage("bot", 0, &StreamChatMessage{Name: "Bot", Login: "bot", Text: "beep", Bot: true}); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := db.GetChatHistory("bot", 0, 10); err != nil || len(history) != 1 || !history[0].Bot {
+		t.Fatalf("expected a message from a bot, got %+v, %v", history, err)
+	}
+}
@@ -22,7 +22,14 @@ var (
 	ErrStreamActive    = errors.New("Can't do that while a stream is active.")
 	ErrStreamNotExist  = errors.New("Unknown stream.")
 	ErrStreamNotHere   = errors.New("Stream is online on another server.")
+	ErrStreamHandover  = errors.New("Stream is still online on the previous instance of this server.")
 	ErrStreamOffline   = errors.New("Stream is offline.")
+	ErrNoCaptions      = errors.New("Captions are disabled for this stream.")
+	ErrMessageNotExist = errors.New("Unknown message.")
+	ErrPollNotExist    = errors.New("There is no poll.")
+	ErrPollActive      = errors.New("Another poll is still open.")
+	ErrAlreadyVoted    = errors.New("Already voted in this poll.")
+	ErrFilterNotExist  = errors.New("Unknown filter.")
 )
 
 const (
@@ -48,6 +55,7 @@ type UserData struct {
 	Activated       bool
 	ActivationToken string
 	StreamToken     string
+	APIToken        string // Empty if the user has none.
 }
 
 type StreamMetadata struct {
@@ -58,6 +66,9 @@ type StreamMetadata struct {
 	Server    string
 	OwnerID   int64
 	NSFW      bool
+	Paced     bool
+	Captions  bool
+	Tags      map[string]string // Segment-wide Matroska tags of the live stream.
 	Panels    []StreamMetadataPanel
 	StreamTrackInfo
 }
@@ -75,6 +86,15 @@ type StreamTrackInfo struct {
 	Height   uint // Hopefully, there's only one video track in the file.
 }
 
+// The current load of a server, as published to the rest of the cluster.
+type NodeLoad struct {
+	Ingests int   // Number of streams broadcast to this server.
+	Viewers int   // Number of connections receiving media from it.
+	Egress  int64 // Bytes per second sent to viewers.
+	// Not accepting broadcasts, so other nodes should not send any here.
+	Draining bool
+}
+
 type FileSize int64
 
 const (
@@ -108,6 +128,93 @@ type StreamRecording struct {
 	Path      string
 	Space     FileSize
 	Timestamp time.Time
+	Markers   []StreamMarker
+	Polls     []StreamPoll
+	Session   int64
+}
+
+type StreamPoll struct {
+	ID       int64
+	Question string
+	Options  []StreamPollOption
+	Ends     time.Time
+	Open     bool // As of when the poll was loaded.
+}
+
+type StreamPollOption struct {
+	Text  string
+	Votes int
+}
+
+type StreamMarker struct {
+	Timecode uint64 // Milliseconds since the start of the broadcast.
+	Label    string
+}
+
+type StreamChatMessage struct {
+	ID        int64
+	Name      string
+	Login     string
+	Anon      string // The anonymous session of the author; see `Context.GetAnonID`.
+	Text      string
+	Action    bool // Sent with `/me`.
+	Bot       bool // Sent by a program using an API token.
+	Timestamp time.Time
+}
+
+// What a user is allowed to do in the chat of a stream.
+type ChatRole int
+
+const (
+	ChatUser ChatRole = iota
+	ChatModerator
+	ChatOwner
+)
+
+// What to do with a chat message that breaks a filter rule.
+type ChatFilterAction int
+
+const (
+	ChatFilterReject ChatFilterAction = iota
+	ChatFilterMask                    // Replace the offending part with asterisks.
+	ChatFilterHold                    // Wait for a moderator to approve the message.
+)
+
+type ChatLinkPolicy int
+
+const (
+	ChatLinksAllowed ChatLinkPolicy = iota
+	ChatLinksModerators
+	ChatLinksDisallowed
+)
+
+type ChatFilterRule struct {
+	ID      int64
+	Pattern string
+	Regex   bool // Otherwise, the pattern is a word or phrase, ignoring case.
+	Action  ChatFilterAction
+}
+
+type ChatFilters struct {
+	Rules      []ChatFilterRule
+	Links      ChatLinkPolicy
+	LinkAction ChatFilterAction
+	MaxCaps    int // Percentage of letters that can be capital; 0 means no limit.
+	CapsAction ChatFilterAction
+}
+
+type StreamHeldMessage struct {
+	StreamChatMessage
+	Reason string
+}
+
+func (m StreamMarker) Seconds() float64 {
+	return float64(m.Timecode) / 1000
+}
+
+func (m StreamMarker) Clock() string {
+	s := m.Timecode / 1000
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
 }
 
 func hashPassword(password []byte) ([]byte, error) {
@@ -139,6 +246,13 @@ func (s *StreamMetadata) Avatar(size int) string {
 	return gravatarURL(s.Email, size)
 }
 
+func (s *StreamMetadata) NowPlaying() string {
+	if s.Tags["ARTIST"] != "" && s.Tags["TITLE"] != "" {
+		return s.Tags["ARTIST"] + " — " + s.Tags["TITLE"]
+	}
+	return s.Tags["TITLE"]
+}
+
 func (h *StreamHistory) Avatar(size int) string {
 	return gravatarURL(h.Email, size)
 }
@@ -170,23 +284,104 @@ type Database interface {
 	ActivateUser(id int64, token string) error
 	GetUserID(login string, password []byte) (int64, error)
 	GetUserFull(id int64) (*UserData, error)
+	// Bots join chats with API tokens instead of cookies; see `Context.GetChatAuthInfo`.
+	GetUserByAPIToken(token string) (*UserData, error)
 	// v--- can assume existence of user with given id
 	SetUserData(id int64, name string, login string, email string, about string, password []byte) (actoken string, e error)
 	NewStreamToken(id int64) error
-	SetStreamName(id int64, name string, nsfw bool) error
+	// Replace the user's API token with a new one, or remove it.
+	NewAPIToken(id int64) error
+	DelAPIToken(id int64) error
+	SetStreamName(id int64, name string, nsfw bool, paced bool, captions bool) error
 	AddStreamPanel(id int64, text string) error
 	SetStreamPanel(id int64, n int64, text string) error
 	DelStreamPanel(id int64, n int64) error
+	SetStreamSlate(id int64, data []byte) error
 	// v--- must accept string ids to be usable from broadcasting nodes (which don't deal in users)
 	StartStream(id string, token string) error
 	StopStream(id string) error
 	GetStreamServer(id string) (string, error)
 	GetStreamMetadata(id string) (*StreamMetadata, error)
 	SetStreamTrackInfo(id string, info *StreamTrackInfo) error
+	SetStreamTags(id string, tags map[string]string) error
+	GetStreamSlate(id string) ([]byte, error)
 	GetRecordings(id string) (*StreamHistory, error)
 	GetRecording(id string, recid int64) (*StreamRecording, error)
+	SetNodeLoad(load NodeLoad) error
+	// Return the least loaded server other than this one that is not draining, if any.
+	GetIdlestNode() (string, *NodeLoad, error)
+	// Return the node that hosts the chat room of a stream, claiming it for this one
+	// if there is none. While the stream is online, that's the one it is on.
+	GetRoomServer(id string) (string, error)
+	// Viewers of a stream on other nodes (relays), as reported by them.
+	SetRelayViewers(id string, viewers int) error
+	GetRelayViewers(id string) (int, error)
+	// A session is a single broadcast, from the first PUT to the timeout. `StopStream` ends it.
+	StartSession(id string) (session int64, e error)
+	// Record the total number of viewers; only the peak is stored.
+	SetSessionViewers(session int64, viewers int) error
+	AddStreamMarker(session int64, timecode uint64, label string) error
+	GetStreamMarkers(session int64) ([]StreamMarker, error)
+	// Session 0 is for messages sent while the stream is offline, which are not replayed.
+	AddChatMessage(id string, session int64, msg *StreamChatMessage) (msgid int64, e error)
+	// Messages sent during a session, oldest first.
+	GetChatReplay(session int64) ([]StreamChatMessage, error)
+	// At most `limit` messages older than `before` (any, if 0), oldest first.
+	GetChatHistory(id string, before int64, limit int) ([]StreamChatMessage, error)
+	// Hide all messages sent so far from the history, but not from replays.
+	ClearChatHistory(id string) error
+	DelChatMessage(id string, msgid int64) error
+	// v--- moderation is per stream; `login` is the user being appointed or banned
+	GetChatRole(id string, login string) (ChatRole, error)
+	// The highest role of anyone who has been logged in while chatting from an anonymous
+	// session, going by their messages and names.
+	GetChatAnonRole(id string, anon string) (ChatRole, error)
+	AddChatModerator(id string, login string) error
+	DelChatModerator(id string, login string) error
+	// Ban a user by login, an anonymous session, or both, for some time or (if 0) forever.
+	AddChatBan(id string, login string, anon string, seconds int) error
+	DelChatBan(id string, login string, anon string) error
+	// If banned, `until` is when the ban expires, or zero if it doesn't.
+	GetChatBan(id string, login string, anon string) (banned bool, until time.Time, e error)
+	// Names are unique within a room, and registered logins are reserved for their owners.
+	// Claims by the same user (or anonymous session) don't conflict, as they may have
+	// several tabs open.
+	ClaimChatName(id string, name string, login string, anon string) (claim int64, e error)
+	ReleaseChatName(claim int64) error
+	// Return the user who has claimed a name, if anyone has.
+	GetChatNameOwner(id string, name string) (login string, anon string, e error)
+	// Block lists belong to a user (or anonymous session) and apply in all rooms.
+	// Blocking is done by name, but applies to whoever had that name at the time.
+	AddChatBlock(login string, anon string, name string, blockedLogin string, blockedAnon string) error
+	DelChatBlock(login string, anon string, name string) error
+	// Check whether a user has blocked someone else.
+	IsChatUserBlocked(login string, anon string, byLogin string, byAnon string) (bool, error)
+	SetChatSlowMode(id string, seconds int) error
+	// Custom commands show a line of text when someone types `/<name>`. An empty
+	// text removes the command.
+	SetChatCommand(id string, name string, text string) error
+	GetChatCommand(id string, name string) (string, error)
+	GetChatSlowMode(id string) (seconds int, e error)
+	// Polls are attached to the current session, if any. Only one can be open at a time.
+	AddChatPoll(id string, question string, options []string, seconds int) (pollid int64, e error)
+	// Close the open poll early.
+	EndChatPoll(id string) error
+	// Return the latest poll, open or not.
+	GetChatPoll(id string) (*StreamPoll, error)
+	// Each login, or anonymous session if not logged in, can vote once while the poll is open.
+	AddChatVote(pollid int64, option int, login string, anon string) error
+	GetStreamPolls(session int64) ([]StreamPoll, error)
+	GetChatFilters(id string) (*ChatFilters, error)
+	AddChatFilterRule(id string, rule ChatFilterRule) (ruleid int64, e error)
+	DelChatFilterRule(id string, ruleid int64) error
+	SetChatLinkPolicy(id string, policy ChatLinkPolicy, action ChatFilterAction) error
+	SetChatCapsLimit(id string, percent int, action ChatFilterAction) error
+	// Messages caught by a filter wait until a moderator approves or rejects them.
+	AddHeldMessage(id string, msg *StreamChatMessage, reason string) (heldid int64, e error)
+	GetHeldMessages(id string) ([]StreamHeldMessage, error)
+	// Remove a held message and return it. Fails if someone else has already done that.
+	TakeHeldMessage(id string, heldid int64) (*StreamHeldMessage, error)
 	// TODO allow removing old recordings
-	// TODO think of how to implement this ---v
-	StartRecording(id string, filename string) (recid int64, sizeLimit int64, e error)
+	StartRecording(id string, session int64, filename string) (recid int64, sizeLimit int64, e error)
 	StopRecording(id string, recid int64, size int64) error
 }
@@ -0,0 +1,26 @@
+// POST /drain
+//     Stop accepting broadcasts and move the existing ones, along with their viewers,
+//     to other nodes. Meant for maintenance before a restart; cannot be undone.
+//
+// This handler should only be reachable by the operator (see the `-admin` flag).
+//
+package main
+
+import "net/http"
+
+type AdminHandler struct {
+	Streams *RetransmissionHandler
+}
+
+func (ctx AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	switch r.URL.Path {
+	case "/drain":
+		if r.Method != "POST" {
+			return RenderInvalidMethod(w, "POST")
+		}
+		ctx.Streams.Drain()
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return RenderError(w, http.StatusNotFound, "")
+}
@@ -1,43 +1,187 @@
 // POST /stream/<name> or PUT /stream/<name>
 //     Broadcast a WebM video/audio file.
 //
+//     If this node is over its configured limits, new (not resuming) broadcasts
+//     are redirected with 307 to the least loaded node in the cluster. While the node
+//     is being drained, all broadcasts are, and ongoing ones are interrupted with
+//     the same redirect so that they resume elsewhere within the timeout.
+//
 //     Accepted input: valid WebM split into arbitrarily many requests in absolutely
 //     any way. Multiple files can be concatenated into a single stream as long as they
 //     contain exactly the same tracks (i.e. their number, codecs, and dimensions.
 //     Otherwise any connected decoders will error and have to restart. Changing,
 //     for example, bitrate or tags is fine.)
 //
+// POST /stream/<name>/captions[?<token>]
+//     >> text string, start optional[int], end int
+//
+//     Show a line of text on the caption track (if enabled in the stream's settings)
+//     from `start` to `end` milliseconds from now. Cues must start within a minute
+//     and last at most as long. Requires either the stream token or the owner's
+//     session cookie.
+//
 // GET /stream/<name>
 //     Receive a published WebM stream. Note that the server makes no attempt
-//     at buffering; if the stream is being broadcast faster than its native framerate,
-//     the client will have to buffer and/or drop frames.
+//     at buffering; if the stream is being broadcast faster than its native framerate
+//     (and the owner has not enabled pacing), the client will have to buffer
+//     and/or drop frames.
+//
+//     If the stream is on another node, the client is redirected there, unless
+//     this node is configured to proxy viewers, in which case it relays the stream
+//     itself. Its chat is then joined with the one on the owning node, so all viewers
+//     see the same messages; methods of `Stream` are not available through a relay.
 //
 // GET /stream/<name> [Upgrade: websocket]
-//     Connect to a JSON-RPC v2.0 node.
+//     Connect to a JSON-RPC v2.0 node. Methods of `Stream` are only available
+//     while the stream is online.
+//
+//     Bots can log in with an API token (see `/user/new-api-token`) by sending
+//     `Authorization: Bearer <token>`; an invalid token is rejected with a 401.
+//     They have the same permissions as the user, but their messages are marked
+//     as sent by a bot, and they can send 20 messages at once, then 2 per second.
 //
 //     Methods of `Chat`:
 //
 //        * `SetName(string)`: assign a (unique) name to this client. This is required to...
+//          Names are unique within a room, ignoring case, and nobody can take a registered
+//          user's login except that user. Logged-in users get their display name (or,
+//          if it is taken, their login) automatically.
 //        * `SendMessage(string)`: broadcast a simple text message to all viewers.
-//        * `RequestHistory()`: ask the server to emit notifications containing the last
-//          few broadcasted text messages.
+//          Fails with one of these error codes if the message is not allowed right now;
+//          the error's data, if any, is the number of seconds to wait before retrying:
+//              -32001: sending too fast (more than 5 messages at once, then 1 per second).
+//                  Three times in a row mutes the user for a minute.
+//              -32002: slow mode is on and the last message was too recent.
+//              -32003: the same text was sent within the last 30 seconds.
+//              -32004: muted for flooding.
+//              -32005: rejected by a filter (see `AddFilter`).
+//          Limits apply to all connections of a user (or anonymous session, or address
+//          if the connection has no session cookie) at once, so reconnecting does
+//          not reset them.
+//          Messages that start with a slash are commands (start with two to send
+//          a message that starts with one):
+//              /me <action>: an action message, same limits as normal ones.
+//              /w <name> <message>: same as `Whisper`.
+//              /ban <name>, /timeout <name> [seconds=600]: (moderators only) same
+//                  as `Ban` and `Timeout`, but by name; everyone is notified.
+//              /clear: (moderators only) clear everyone's chat log, including the history
+//                  returned by `RequestHistory`. Replays of recordings are not affected.
+//              /poll <seconds> <question> | <option> | <option>..., /endpoll:
+//                  (moderators only) same as `StartPoll` and `EndPoll`.
+//              /slow <seconds|off>: (owner only) same as `SetSlowMode`.
+//              /command <name> [response]: (owner only) define a custom command
+//                  that shows a notice to everyone, or remove it without a response.
+//        * `Whisper(name string, text string)`: send a private message to all
+//          connections of whoever has this name, as well as this one. Whispers are
+//          subject to bans and rate limits, but are never saved or included in
+//          the history.
+//        * `Block(name string)`, `Unblock(name string)`: stop (or resume) accepting
+//          whispers from whoever has this name now. Block lists belong to the user
+//          (or anonymous session) and apply in all rooms; `Unblock` takes the name
+//          the user had when blocked.
+//        * `RequestHistory(before int, limit int)`: return up to `limit` (at most 100)
+//          messages sent before the one with ID `before`, or the latest ones if it is 0,
+//          oldest first. Each is a list of the name of the notification that sent it
+//          (`Chat.Message` or `Chat.Action`) followed by its parameters. The last few
+//          messages are also sent as notifications upon connection.
+//        * `AddModerator(login string)`, `RemoveModerator(login string)`: (owner only)
+//          let another user ban people and delete messages.
+//        * `Ban(login string, anon string)`, `Timeout(login string, anon string, seconds int)`,
+//          `Unban(login string, anon string)`: (moderators only) stop a user, an anonymous
+//          session, or both from sending messages, either forever or for a while.
+//          Bans are per stream and persist across broadcasts. Moderators cannot ban
+//          each other or the owner, including by the sessions they have chatted from.
+//        * `DeleteMessage(id int)`: (moderators only) remove a message for everyone.
+//        * `SetSlowMode(seconds int)`: (owner only) limit everyone except moderators
+//          to one message per this many seconds, up to an hour. 0 turns it off.
+//        * `StartPoll(question string, options []string, seconds int)`: (moderators only)
+//          ask a question with 2 to 10 answers for 10 to 3600 seconds. Only one poll
+//          can be open at a time. Results are saved with the broadcast and shown
+//          alongside its recordings.
+//        * `AddFilter(pattern string, regex bool, action int) int`: (owner only) act on
+//          messages that contain a word or phrase (ignoring case), or that match
+//          a regular expression. The action is one of:
+//              0: reject the message;
+//              1: replace the offending text with asterisks;
+//              2: hold the message until a moderator approves it.
+//          Returns the ID of the rule. Filters apply to everyone except the owner.
+//        * `RemoveFilter(id int)`: (owner only) remove a rule added by `AddFilter`.
+//        * `SetLinkPolicy(policy int, action int)`: (owner only) whether links are allowed
+//          from everyone (0), only moderators (1), or nobody (2), and what to do
+//          with the rest. Masking removes the links.
+//        * `SetCapsLimit(percent int, action int)`: (owner only) act on messages in which
+//          more than this share of the letters are capital, or 0 to allow any.
+//          Masking makes them lowercase. Very short messages are not checked.
+//        * `GetFilters() object`: (owner only) return the rules and settings above.
+//        * `ApproveMessage(id int)`, `RejectMessage(id int)`: (moderators only) show
+//          a held message to everyone, or discard it.
+//        * `EndPoll()`: (moderators only) close the current poll early.
+//        * `Vote(id int, option int)`: vote in the current poll; once per login, or per
+//          anonymous session if not logged in. Sessions are kept in a cookie set by
+//          the room page; connections without one cannot vote.
+//
+//     Methods of `Stream`:
 //
-//     TODO Methods of `Stream`.
+//        * `AddMarker(string)`: (owner only) mark the current position of the stream
+//          with a label. Markers are saved as chapters in recordings.
 //
 //     Notifications:
 //
 //        * `Chat.AcquiredName(user string)`: upon a successful `SetName`.
 //          May be emitted automatically at the start of a connection if already logged in.
-//        * `Chat.Message(user string, text string)`: a broadcasted text message.
+//        * `Chat.Message(user string, text string, login string, id int, time string, anon string, bot bool)`:
+//          a broadcasted text message. `login` is empty for anonymous users; `anon`
+//          identifies the author's session for the purposes of banning, and is only
+//          sent to moderators (it is empty for everyone else). `bot` is set if the author
+//          has connected with an API token.
+//        * `Chat.Action(...)`: same as `Chat.Message`, but sent with `/me`.
+//        * `Chat.Whisper(from string, to string, text string, login string)`: sent with
+//          `Whisper` to the recipient and the sender's connection.
+//        * `Chat.Notice(text string)`: a message from the server or a custom command.
+//        * `Chat.Clear(name string)`: a moderator has cleared the chat.
+//        * `Chat.MessageDeleted(id int)`: a moderator has deleted a message.
+//        * `Chat.Banned(seconds int)`: this user or session has been banned (0)
+//          or timed out for this many seconds.
+//        * `Chat.UserBanned(login string, anon string, seconds int, by string)`: (moderators
+//          only) the moderator named `by` has banned or timed out someone.
+//        * `Chat.SlowMode(seconds int)`: slow mode has been changed. Also emitted
+//          on connection if it is on.
+//        * `Chat.MessageHeld(id int, user string, text string, login string, action bool, anon string, reason string)`:
+//          (moderators only) a message is waiting for approval. Also emitted on connection
+//          for each such message.
+//        * `Chat.HeldResolved(id int, approved bool)`: (moderators only) a held message
+//          has been approved or rejected.
+//        * `Chat.PollUpdate(id int, question string, options []string, votes []int, ends string, open bool)`:
+//          a poll has been started, voted in, or closed. Also emitted on connection
+//          if a poll is open. The last update of a poll has `open` unset.
+//        * `RPC.Shutdown()`: the node is about to go down, and the connection will be
+//          closed shortly.
+//        * `RPC.Redirect(url string)`: the chat is on another node; reconnect to `url`.
+//          Sent instead of `RPC.Loaded` to connections made to the wrong node, and
+//          to everyone in a room that has moved because the stream has gone online
+//          elsewhere.
+//        * `Stream.Draining(server string)`: the node is going down; the broadcaster
+//          should reconnect to `server` (empty if none is known). Viewers will be sent
+//          an `RPC.Redirect` once the stream moves.
+//        * `Stream.Online()`, `Stream.Offline()`: emitted on connection and whenever
+//          the broadcast starts or ends. The chat stays open while the stream is offline.
+//        * `Stream.ViewerCount(n int)`: the number of people watching the stream,
+//          including those on other nodes and those without a websocket.
+//        * `Stream.Metadata(tags object)`: segment-wide Matroska tags (e.g. TITLE, ARTIST)
+//          sent by the broadcaster. Emitted on connection and whenever they change.
 //
 package main
 
 import (
+	"errors"
 	"golang.org/x/net/websocket"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type RetransmissionHandler struct {
@@ -45,16 +189,30 @@ type RetransmissionHandler struct {
 	chatLock sync.Mutex
 	chats    map[string]*Chat
 	*Context
+	// Bytes per second sent to viewers, as of the last `publishLoad` tick.
+	egressRate int64
+	// Streams from other nodes, see `relay`. Connections to their owners are made
+	// while holding the lock for that stream.
+	relays        BroadcastSet
+	relayLock     keyedMutex
+	relayChatLock keyedMutex
+	// Nonzero after `Drain`.
+	draining int32
+	// Running instances of `record`.
+	recorders sync.WaitGroup
 }
 
+// How often to recompute this node's load and share it with the rest of the cluster.
+const loadInterval = 5 * time.Second
+
 func NewRetransmissionHandler(c *Context) *RetransmissionHandler {
 	ctx := &RetransmissionHandler{chats: make(map[string]*Chat), Context: c}
 	ctx.Timeout = c.StreamKeepAlive
+	ctx.SlateDelay = c.StreamSlateDelay
 	ctx.OnStreamClose = func(id string) {
 		ctx.chatLock.Lock()
 		if chat, ok := ctx.chats[id]; ok {
-			chat.Close()
-			delete(ctx.chats, id)
+			chat.SetOnline(false, 0)
 		}
 		ctx.chatLock.Unlock()
 		if err := ctx.StopStream(id); err != nil {
@@ -66,10 +224,189 @@ func NewRetransmissionHandler(c *Context) *RetransmissionHandler {
 			log.Println("Error setting stream metadata: ", err)
 		}
 	}
+	ctx.OnStreamTags = func(id string, tags map[string]string) {
+		if err := ctx.SetStreamTags(id, tags); err != nil {
+			log.Println("Error setting stream tags: ", err)
+		}
+		ctx.chatLock.Lock()
+		if chat, ok := ctx.chats[id]; ok {
+			chat.Notify("Stream.Metadata", tags)
+		}
+		ctx.chatLock.Unlock()
+	}
+	ctx.OnStreamOpen = func(id string, cast *Broadcast) {
+		cast.ForwardTags = c.ForwardTags
+		if meta, err := ctx.GetStreamMetadata(id); err == nil {
+			cast.Paced = meta.Paced
+			cast.Captions = meta.Captions
+		}
+		if data, err := ctx.GetStreamSlate(id); err == nil && len(data) != 0 {
+			if cast.Slate, err = ParseSlate(data); err != nil {
+				log.Println("Error loading the slate: ", err)
+			}
+		}
+		var err error
+		if cast.Session, err = ctx.StartSession(id); err != nil {
+			log.Println("Error starting a session: ", err)
+		}
+		ctx.chatLock.Lock()
+		if chat, ok := ctx.chats[id]; ok {
+			chat.SetOnline(true, cast.Session)
+		}
+		ctx.chatLock.Unlock()
+		ctx.recorders.Add(1)
+		go ctx.record(id, cast)
+	}
+	go ctx.publishLoad()
 	return ctx
 }
 
+func (ctx *RetransmissionHandler) Load() NodeLoad {
+	ingests, viewers := ctx.BroadcastSet.Load()
+	return NodeLoad{ingests, viewers, atomic.LoadInt64(&ctx.egressRate), ctx.Draining()}
+}
+
+func (ctx *RetransmissionHandler) publishLoad() {
+	sent := ctx.Egress()
+	for range time.Tick(loadInterval) {
+		total := ctx.Egress()
+		atomic.StoreInt64(&ctx.egressRate, (total-sent)*int64(time.Second)/int64(loadInterval))
+		sent = total
+		if err := ctx.SetNodeLoad(ctx.Load()); err != nil {
+			log.Println("Error publishing node load: ", err)
+		}
+		ctx.countViewers()
+		ctx.tidyRooms()
+	}
+}
+
+// Relays store the number of their viewers in the database; the node
+// that owns a stream adds them to its own.
+func (ctx *RetransmissionHandler) countViewers() {
+	for id, cast := range ctx.relays.Streams() {
+		if err := ctx.SetRelayViewers(id, cast.Audience()); err != nil {
+			log.Println("Error reporting relay viewers: ", err)
+		}
+	}
+	for id, cast := range ctx.Streams() {
+		n, err := ctx.GetRelayViewers(id)
+		if err != nil {
+			log.Println("Error counting relay viewers: ", err)
+		}
+		n += cast.Audience()
+		if err := ctx.SetSessionViewers(cast.Session, n); err != nil {
+			log.Println("Error saving viewer count: ", err)
+		}
+		ctx.chatLock.Lock()
+		if chat, ok := ctx.chats[id]; ok {
+			chat.SetViewerCount(n)
+		}
+		ctx.chatLock.Unlock()
+	}
+}
+
+// Find a node that is less busy than this one, if this one is over its limits
+// or is being drained (in which case any other node will do).
+func (ctx *RetransmissionHandler) idlerNode() (string, bool) {
+	load := ctx.Load()
+	draining := ctx.Draining()
+	if !draining && (ctx.MaxIngests == 0 || load.Ingests < ctx.MaxIngests) && (ctx.MaxEgress == 0 || load.Egress < ctx.MaxEgress) {
+		return "", false
+	}
+	server, other, err := ctx.GetIdlestNode()
+	if err != nil {
+		if err != ErrStreamNotExist && err != ErrNotSupported {
+			log.Println("Error finding an idle node: ", err)
+		}
+		return "", false
+	}
+	if !draining && other.Ingests >= load.Ingests && other.Egress >= load.Egress {
+		return "", false
+	}
+	return server, true
+}
+
+func (ctx *RetransmissionHandler) Draining() bool {
+	return atomic.LoadInt32(&ctx.draining) != 0
+}
+
+// Stop accepting broadcasts and move the existing ones to other nodes. Broadcasters
+// are told to reconnect elsewhere; the streams stay here for `StreamKeepAlive`
+// so that their viewers can be redirected once they resume.
+func (ctx *RetransmissionHandler) Drain() {
+	if !atomic.CompareAndSwapInt32(&ctx.draining, 0, 1) {
+		return
+	}
+	// Tell the other nodes right away so they stop sending broadcasters here.
+	if err := ctx.SetNodeLoad(ctx.Load()); err != nil {
+		log.Println("Error publishing node load: ", err)
+	}
+	server, _ := ctx.idlerNode()
+	for id, cast := range ctx.Streams() {
+		ctx.chatLock.Lock()
+		if chat, ok := ctx.chats[id]; ok {
+			chat.Notify("Stream.Draining", server)
+		}
+		ctx.chatLock.Unlock()
+		go ctx.follow(id, cast)
+	}
+}
+
+// Close all chats and streams (which releases them in the database) and finish
+// writing the recordings. Returns false if that takes longer than `timeout`.
+func (ctx *RetransmissionHandler) Shutdown(timeout time.Duration) bool {
+	ctx.chatLock.Lock()
+	for _, chat := range ctx.chats {
+		chat.Notify("RPC.Shutdown")
+	}
+	ctx.chatLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ctx.relays.Shutdown()
+		ctx.BroadcastSet.Shutdown()
+		ctx.chatLock.Lock()
+		for id, chat := range ctx.chats {
+			delete(ctx.chats, id)
+			chat.Close()
+		}
+		ctx.chatLock.Unlock()
+		ctx.recorders.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Wait for a drained stream to reappear on another node, then send its viewers there.
+func (ctx *RetransmissionHandler) follow(id string, cast *Broadcast) {
+	for range time.Tick(time.Second) {
+		if cast.Closed {
+			return
+		}
+		if server, err := ctx.GetStreamServer(id); err == ErrStreamNotHere {
+			ctx.chatLock.Lock()
+			if chat, ok := ctx.chats[id]; ok {
+				chat.Notify("RPC.Redirect", "//"+server+"/stream/"+id)
+			}
+			ctx.chatLock.Unlock()
+			return
+		}
+	}
+}
+
 func (ctx *RetransmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	if sep := strings.IndexRune(r.URL.Path[8:], '/'); sep > 0 && r.URL.Path[9+sep:] == "captions" {
+		if r.Method != "POST" {
+			return RenderInvalidMethod(w, "POST")
+		}
+		return ctx.caption(w, r, r.URL.Path[8:8+sep])
+	}
+
 	switch {
 	case r.URL.Path == "/stream/" || strings.ContainsRune(r.URL.Path[8:], '/'):
 		return RenderError(w, http.StatusNotFound, "")
@@ -82,6 +419,24 @@ func (ctx *RetransmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// The methods of `Stream` exposed over JSON-RPC.
+type streamRPC struct {
+	cast  *Broadcast
+	owner bool
+	db    Database
+}
+
+func (ctx *streamRPC) AddMarker(args *RPCSingleStringArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errors.New("only the owner can add markers")
+	}
+	label := strings.TrimSpace(args.First)
+	if len(label) == 0 || len(label) > 256 {
+		return errors.New("label must have between 1 and 256 characters")
+	}
+	return ctx.db.AddStreamMarker(ctx.cast.Session, ctx.cast.Timecode(), label)
+}
+
 func wantsWebsocket(r *http.Request) bool {
 	if upgrade, ok := r.Header["Upgrade"]; ok {
 		for i := range upgrade {
@@ -99,20 +454,38 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 	}
 
 	stream, ok := ctx.Readable(id)
+	if ok && ctx.Draining() {
+		// The broadcaster may have already resumed on another node.
+		if _, err := ctx.GetStreamServer(id); err == ErrStreamNotHere {
+			ok = false
+		}
+	}
 	if !ok {
 		switch server, err := ctx.GetStreamServer(id); err {
 		case ErrStreamNotHere:
+			if ctx.ProxyViewers {
+				return ctx.proxy(w, r, id, server)
+			}
 			if wantsWebsocket(r) {
-				// simply redirecting won't do -- browsers will throw an error.
-				websocket.Handler(func(ws *websocket.Conn) {
-					RPCPushEvent(ws, "RPC.Redirect", "//"+server+r.URL.Path)
-				}).ServeHTTP(w, r)
-				return nil
+				return redirectRPC(w, r, server)
 			}
 			http.Redirect(w, r, "//"+server+r.URL.Path, http.StatusTemporaryRedirect)
 			return nil
 		case ErrStreamOffline, nil:
-			return RenderError(w, http.StatusNotFound, "Stream offline.")
+			if !wantsWebsocket(r) {
+				return RenderError(w, http.StatusNotFound, "Stream offline.")
+			}
+			// The chat room stays open while the stream is offline, though not
+			// necessarily on this node.
+			if server, err = ctx.GetRoomServer(id); err == ErrStreamNotHere {
+				if ctx.ProxyViewers {
+					return ctx.relayRPC(w, r, id, server)
+				}
+				return redirectRPC(w, r, server)
+			}
+			if err != nil {
+				return err
+			}
 		case ErrStreamNotExist:
 			return RenderError(w, http.StatusNotFound, "Invalid stream name.")
 		default:
@@ -120,24 +493,54 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 		}
 	}
 
+	if wantsWebsocket(r) && ctx.IsRelay(r, id) {
+		websocket.Handler(func(ws *websocket.Conn) {
+			// `tidyRooms` may close the room before the connection joins it.
+			for !ctx.chat(id, stream).RunRelay(ws) {
+			}
+		}).ServeHTTP(w, r)
+		return nil
+	}
+
 	if wantsWebsocket(r) {
-		auth, err := ctx.GetAuthInfo(r)
+		auth, bot, err := ctx.GetChatAuthInfo(r)
+		if err == ErrInvalidToken {
+			return RenderError(w, http.StatusUnauthorized, "Invalid API token.")
+		}
 		if err != nil && err != ErrUserNotExist {
 			return err
 		}
+		owner := false
+		if auth != nil {
+			meta, err := ctx.GetStreamMetadata(id)
+			if err != nil && err != ErrStreamOffline {
+				return err
+			}
+			owner = meta.OwnerID == auth.ID
+		}
+		anon := ctx.GetAnonID(r)
 		websocket.Handler(func(ws *websocket.Conn) {
-			ctx.chatLock.Lock()
-			chat, ok := ctx.chats[id]
-			if !ok {
-				chat = NewChat(20)
-				ctx.chats[id] = chat
+			var methods interface{}
+			if stream != nil {
+				if tags := stream.Tags(); len(tags) != 0 {
+					RPCPushEvent(ws, "Stream.Metadata", tags)
+				}
+				methods = &streamRPC{stream, owner, ctx.Database}
+			}
+			for !ctx.chat(id, stream).RunRPC(ws, auth, bot, anon, methods) {
 			}
-			ctx.chatLock.Unlock()
-			chat.RunRPC(ws, auth)
 		}).ServeHTTP(w, r)
 		return nil
 	}
 
+	return ctx.pipe(w, r, id, stream)
+}
+
+// Set by other nodes when relaying a stream or its chat; see `Context.RelayToken`.
+// Relays are not counted as viewers, as they report their own viewers instead.
+const relayHeader = "X-Webmcast-Relay"
+
+func (ctx *RetransmissionHandler) pipe(w http.ResponseWriter, r *http.Request, id string, stream *Broadcast) error {
 	header := w.Header()
 	header.Set("Access-Control-Allow-Origin", "*")
 	header.Set("Cache-Control", "no-cache")
@@ -150,9 +553,13 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 
 	stream.Connect(ch, false)
 	defer stream.Disconnect(ch)
+	if !ctx.IsRelay(r, id) {
+		defer stream.Watch()()
+	}
 
 	for chunk := range ch {
-		if _, err := w.Write(chunk); err != nil || stream.Closed {
+		n, err := w.Write(chunk)
+		if ctx.CountEgress(n); err != nil || stream.Closed {
 			break
 		}
 		if flushable {
@@ -162,17 +569,107 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 	return nil
 }
 
-func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request, id string) error {
-	switch err := ctx.StartStream(id, r.URL.RawQuery); err {
+func redirectRPC(w http.ResponseWriter, r *http.Request, server string) error {
+	// simply redirecting won't do -- browsers will throw an error.
+	websocket.Handler(func(ws *websocket.Conn) {
+		RPCPushEvent(ws, "RPC.Redirect", "//"+server+r.URL.Path)
+	}).ServeHTTP(w, r)
+	return nil
+}
+
+// Find the chat room of a stream, creating it if necessary. Rooms are not tied
+// to streams; they stay open for as long as there is someone in them. `cast` is nil
+// if the stream is offline.
+func (ctx *RetransmissionHandler) chat(id string, cast *Broadcast) *Chat {
+	ctx.chatLock.Lock()
+	defer ctx.chatLock.Unlock()
+	chat, ok := ctx.chats[id]
+	if !ok {
+		chat = NewChat(20)
+		chat.db = ctx.Database
+		chat.stream = id
+		if slow, err := ctx.GetChatSlowMode(id); err == nil {
+			chat.slow = int32(slow)
+		}
+		chat.loadFilters()
+		if cast != nil {
+			chat.online = true
+			atomic.StoreInt64(&chat.session, cast.Session)
+		}
+		ctx.chats[id] = chat
+	}
+	return chat
+}
+
+// Close rooms nobody is in while their streams are offline, and those that have moved
+// to another node along with their streams. Also fix the status of the rest in case
+// a stream has gone online while its room was being created.
+func (ctx *RetransmissionHandler) tidyRooms() {
+	streams := ctx.Streams()
+	ctx.chatLock.Lock()
+	defer ctx.chatLock.Unlock()
+	for id, chat := range ctx.chats {
+		if chat.upstream != nil {
+			// Relays have no streams of their own; their status comes from upstream.
+			if chat.Idle() {
+				delete(ctx.chats, id)
+				chat.Close()
+			}
+			continue
+		}
+		if cast, online := streams[id]; online {
+			chat.SetOnline(true, cast.Session)
+		} else if chat.Idle() {
+			delete(ctx.chats, id)
+			chat.Close()
+		} else if server, err := ctx.GetRoomServer(id); err == ErrStreamNotHere {
+			// Otherwise the people here would be left talking among themselves.
+			delete(ctx.chats, id)
+			if ctx.ProxyViewers {
+				server = ""
+			}
+			chat.Move(server)
+			chat.Close()
+		} else {
+			if err != nil {
+				log.Println("Error checking the chat room: ", err)
+			}
+			chat.SetOnline(false, 0)
+		}
+	}
+}
+
+func renderStreamError(w http.ResponseWriter, err error) error {
+	switch err {
 	case ErrInvalidToken:
 		return RenderError(w, http.StatusForbidden, "Invalid token.")
 	case ErrStreamNotExist:
 		return RenderError(w, http.StatusNotFound, "Invalid stream ID.")
 	case ErrStreamNotHere:
 		return RenderError(w, http.StatusBadRequest, "Wrong server.")
-	default:
-		return err
-	case nil:
+	case ErrStreamHandover:
+		// The broadcaster will be able to resume within the timeout.
+		w.Header().Set("Retry-After", "1")
+		return RenderError(w, http.StatusServiceUnavailable, err.Error())
+	}
+	return err
+}
+
+func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request, id string) error {
+	if _, ok := ctx.Readable(id); !ok || ctx.Draining() {
+		// A stream that is already here (e.g. reconnecting within the timeout) stays
+		// here; new ones go somewhere else if this node is too busy. The token is
+		// checked there, so nothing is claimed yet.
+		if server, ok := ctx.idlerNode(); ok {
+			http.Redirect(w, r, "//"+server+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return nil
+		}
+		if ctx.Draining() {
+			return RenderError(w, http.StatusServiceUnavailable, "This server is going down for maintenance.")
+		}
+	}
+	if err := ctx.StartStream(id, r.URL.RawQuery); err != nil {
+		return renderStreamError(w, err)
 	}
 
 	stream, ok := ctx.Writable(id)
@@ -182,7 +679,34 @@ func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request,
 	defer stream.Close()
 
 	buffer := [16384]byte{}
+	checked := time.Now()
 	for {
+		// The token may be revoked while the stream is active. This is a cheap check
+		// so long as the token stays valid, as it's cached.
+		if stream.Closed {
+			// The server is shutting down.
+			w.Header().Set("Connection", "close")
+			return RenderError(w, http.StatusServiceUnavailable, "This server is going down for maintenance.")
+		}
+		if time.Since(checked) > time.Second {
+			if ctx.Draining() {
+				// Release the stream so that the broadcaster can resume it on
+				// another node before the timeout, then drop the connection.
+				if err := ctx.StopStream(id); err != nil {
+					log.Println("Error releasing the stream: ", err)
+				}
+				w.Header().Set("Connection", "close")
+				if server, ok := ctx.idlerNode(); ok {
+					http.Redirect(w, r, "//"+server+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+					return nil
+				}
+				return RenderError(w, http.StatusServiceUnavailable, "This server is going down for maintenance.")
+			}
+			if err := ctx.StartStream(id, r.URL.RawQuery); err != nil {
+				return renderStreamError(w, err)
+			}
+			checked = time.Now()
+		}
 		n, err := r.Body.Read(buffer[:])
 		if n != 0 {
 			if _, err := stream.Write(buffer[:n]); err != nil {
@@ -196,3 +720,65 @@ func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request,
 		}
 	}
 }
+
+func (ctx *RetransmissionHandler) caption(w http.ResponseWriter, r *http.Request, id string) error {
+	stream, ok := ctx.Readable(id)
+	if !ok {
+		if server, err := ctx.GetStreamServer(id); err == ErrStreamNotHere {
+			// 307 makes the client repeat the POST on the other server.
+			http.Redirect(w, r, "//"+server+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return nil
+		}
+		return RenderError(w, http.StatusNotFound, "Stream offline.")
+	}
+
+	if r.URL.RawQuery != "" {
+		// The stream is already active on this server, so this only checks the token.
+		switch err := ctx.StartStream(id, r.URL.RawQuery); err {
+		case ErrInvalidToken:
+			return RenderError(w, http.StatusForbidden, "Invalid token.")
+		default:
+			return err
+		case nil:
+		}
+	} else {
+		user, err := ctx.GetAuthInfo(r)
+		if err == ErrUserNotExist {
+			return RenderError(w, http.StatusForbidden, "Must be logged in or provide a token.")
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := ctx.GetStreamMetadata(id)
+		if err != nil && err != ErrStreamOffline {
+			return err
+		}
+		if meta.OwnerID != user.ID {
+			return RenderError(w, http.StatusForbidden, "You do not own this stream.")
+		}
+	}
+
+	text := strings.TrimSpace(r.FormValue("text"))
+	start, err := strconv.ParseUint(r.FormValue("start"), 10, 32)
+	if r.FormValue("start") == "" {
+		start, err = 0, nil
+	}
+	end, err2 := strconv.ParseUint(r.FormValue("end"), 10, 32)
+	if err != nil || err2 != nil || end <= start || end-start > 60000 {
+		return RenderError(w, http.StatusBadRequest, "Cues must last between 1 ms and 1 minute.")
+	}
+	if start > 60000 {
+		return RenderError(w, http.StatusBadRequest, "Cues must start within a minute.")
+	}
+	if len(text) == 0 || len(text) > 1024 {
+		return RenderError(w, http.StatusBadRequest, "Cues must have between 1 and 1024 characters.")
+	}
+	delay := time.Duration(start) * time.Millisecond
+	if err = stream.Caption(text, delay, time.Duration(end)*time.Millisecond-delay); err == ErrNoCaptions {
+		return RenderError(w, http.StatusForbidden, err.Error())
+	}
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIdlerNode(t *testing.T) {
+	path := t.TempDir() + "/load.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	ctx := &RetransmissionHandler{Context: &Context{Database: a, MaxIngests: 1}}
+	if server, ok := ctx.idlerNode(); ok {
+		t.Fatalf("an idle node sent a broadcast to %q", server)
+	}
+	ctx.Writable("alice")
+	if err := b.SetNodeLoad(NodeLoad{Ingests: 1, Viewers: 10, Egress: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if server, ok := ctx.idlerNode(); ok {
+		t.Fatalf("sent a broadcast to %q, which is just as busy", server)
+	}
+	if err := b.SetNodeLoad(NodeLoad{}); err != nil {
+		t.Fatal(err)
+	}
+	if server, ok := ctx.idlerNode(); !ok || server != "b:8000" {
+		t.Fatalf("expected to send a broadcast to b:8000, got %q", server)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	path := t.TempDir() + "/drain.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	b := testSQLDatabase(t, "b:8000", path)
+	if err := b.SetNodeLoad(NodeLoad{Ingests: 100, Viewers: 1000, Egress: 1 << 30}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &RetransmissionHandler{Context: &Context{Database: a}}
+	if server, ok := ctx.idlerNode(); ok {
+		t.Fatalf("a node without limits sent a broadcast to %q", server)
+	}
+	ctx.Drain()
+	if !ctx.Draining() {
+		t.Fatal("the node is not draining")
+	}
+	// Any other node is better than one that is going down.
+	if server, ok := ctx.idlerNode(); !ok || server != "b:8000" {
+		t.Fatalf("expected to send a broadcast to b:8000, got %q", server)
+	}
+	// Neither is a node that is going down too.
+	if err := b.SetNodeLoad(NodeLoad{Draining: true}); err != nil {
+		t.Fatal(err)
+	}
+	if server, ok := ctx.idlerNode(); ok {
+		t.Fatalf("sent a broadcast to %q, which is draining", server)
+	}
+}
+
+func TestCountViewers(t *testing.T) {
+	path := t.TempDir() + "/viewers.db"
+	a := testSQLDatabase(t, "a:8000", path)
+	testSQLStreamer(t, a, "alice")
+	session, err := a.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &RetransmissionHandler{Context: &Context{Database: a}}
+	cast, _ := owner.Writable("alice")
+	cast.Session = session
+	defer cast.Watch()()
+	relay := &RetransmissionHandler{Context: &Context{Database: testSQLDatabase(t, "b:8000", path)}}
+	relayed, _ := relay.relays.Writable("alice")
+	defer relayed.Watch()()
+	defer relayed.Watch()()
+	relay.countViewers()
+	owner.countViewers()
+	peak := 0
+	if err := a.QueryRow("select peak from sessions where id = ?", session).Scan(&peak); err != nil || peak != 3 {
+		t.Fatalf("expected 3 viewers, got %d (error: %v)", peak, err)
+	}
+}
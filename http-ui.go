@@ -7,6 +7,20 @@
 // GET /rec/<name>/<id>
 //     Watch a particular recording in the HTML5 player.
 //
+// GET /rec/<name>/<id>
+// Upgrade: websocket
+//     Replay the chat of the broadcast the recording was made during. JSON-RPC
+//     methods, called with the playback position in seconds:
+//
+//         Replay.Seek(position) -> null
+//             Send the last few messages before the position, e.g. after jumping
+//             to a different part of the recording.
+//
+//         Replay.Sync(position) -> null
+//             Send the messages between the previous position and this one.
+//
+//     Messages are sent as `Chat.Message` notifications, same as in the live chat.
+//
 // GET /user/
 // POST /user/
 //     >> password-old string, username, displayname, email, password, about optional[string]
@@ -27,14 +41,27 @@
 //
 // POST /user/new-token
 //
+// POST /user/new-api-token
+//     Create or replace the token bots use to chat as this user.
+//
+// POST /user/del-api-token
+//
+// POST /user/set-stream-slate
+//     >> slate optional[file] (a short WebM; leave empty to remove the current one)
+//
 package main
 
 import (
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
+const maxSlateSize = 4 * MiB
+
 type UIHandler struct {
 	*Context
 }
@@ -72,6 +99,9 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 			return RenderError(w, http.StatusNotFound, "Invalid stream name.")
 		case nil, ErrStreamOffline:
 		}
+		if err := ctx.SetAnonID(w, r); err != nil {
+			return err
+		}
 		return Render(w, http.StatusOK, Room{ID: id, Editable: user != nil && meta.OwnerID == user.ID, Online: err == nil, Meta: meta, User: user})
 	}
 
@@ -89,6 +119,16 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 			if err != nil {
 				return err
 			}
+			if wantsWebsocket(r) {
+				messages, err := ctx.GetChatReplay(meta.Session)
+				if err != nil {
+					return err
+				}
+				websocket.Handler(func(ws *websocket.Conn) {
+					RunReplay(ws, meta, messages)
+				}).ServeHTTP(w, r)
+				return nil
+			}
 			return Render(w, http.StatusOK, Recording{ID: id[:sep], Meta: meta, User: user})
 		}
 
@@ -262,7 +302,7 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 		}
 		return redirectBack(w, r, "/user/", http.StatusSeeOther)
 
-	case "/user/new-token", "/user/set-stream-name", "/user/set-stream-panel", "/user/del-stream-panel":
+	case "/user/new-token", "/user/new-api-token", "/user/del-api-token", "/user/set-stream-name", "/user/set-stream-panel", "/user/del-stream-panel", "/user/set-stream-slate":
 		if r.Method != "POST" {
 			return RenderInvalidMethod(w, "POST")
 		}
@@ -274,8 +314,14 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 		case "/user/new-token":
 			err = ctx.NewStreamToken(user.ID)
 
+		case "/user/new-api-token":
+			err = ctx.NewAPIToken(user.ID)
+
+		case "/user/del-api-token":
+			err = ctx.DelAPIToken(user.ID)
+
 		case "/user/set-stream-name":
-			err = ctx.SetStreamName(user.ID, r.FormValue("value"), r.FormValue("nsfw") == "yes")
+			err = ctx.SetStreamName(user.ID, r.FormValue("value"), r.FormValue("nsfw") == "yes", r.FormValue("paced") == "yes", r.FormValue("captions") == "yes")
 
 		case "/user/set-stream-panel":
 			// TODO image
@@ -295,6 +341,32 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 				return RenderError(w, http.StatusBadRequest, "Invalid panel id.")
 			}
 			err = ctx.DelStreamPanel(user.ID, id)
+
+		case "/user/set-stream-slate":
+			// Otherwise up to 32 MiB would be parsed (and spilled to disk) before
+			// the size could be checked. The rest of the form is tiny.
+			r.Body = http.MaxBytesReader(w, r.Body, int64(maxSlateSize+KiB))
+			var data []byte
+			switch f, _, ferr := r.FormFile("slate"); ferr {
+			case nil:
+				data, err = ioutil.ReadAll(io.LimitReader(f, int64(maxSlateSize)+1))
+				f.Close()
+				if err != nil {
+					return err
+				}
+			case http.ErrMissingFile:
+			default:
+				return RenderError(w, http.StatusBadRequest, "The slate must be smaller than 4 MiB.")
+			}
+			if FileSize(len(data)) > maxSlateSize {
+				return RenderError(w, http.StatusBadRequest, "The slate must be smaller than 4 MiB.")
+			}
+			if len(data) != 0 {
+				if _, err := ParseSlate(data); err != nil {
+					return RenderError(w, http.StatusBadRequest, "Invalid slate: "+err.Error())
+				}
+			}
+			err = ctx.SetStreamSlate(user.ID, data)
 		}
 
 		if err == nil {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// A listening socket along with the address it was requested for, which is how
+// it is recognized when passed to another process (see `upgrade`).
+type namedListener struct {
+	net.Listener
+	name string
+}
+
+// Sockets passed in by systemd or by the previous instance of this server.
+var inheritedListeners = inheritListeners()
+
+// Reuse an inherited socket for an address, or bind a new one. Sockets from systemd
+// are matched by their FileDescriptorName; if none match, they are used in order.
+func listen(addr string) (*namedListener, error) {
+	for i, l := range inheritedListeners {
+		if l.name == addr {
+			inheritedListeners = append(inheritedListeners[:i], inheritedListeners[i+1:]...)
+			return l, nil
+		}
+	}
+	if len(inheritedListeners) != 0 {
+		l := inheritedListeners[0]
+		inheritedListeners = inheritedListeners[1:]
+		return &namedListener{l.Listener, addr}, nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &namedListener{l, addr}, nil
+}
+
+// Serve requests in the background until the server is shut down.
+func serve(server *http.Server, l net.Listener) {
+	go func() {
+		if err := server.Serve(l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenInherited(t *testing.T) {
+	defer func(saved []*namedListener) { inheritedListeners = saved }(inheritedListeners)
+	inheritedListeners = nil
+	for _, name := range []string{"", ":8000"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		inheritedListeners = append(inheritedListeners, &namedListener{l, name})
+	}
+	unnamed, named := inheritedListeners[0].Listener, inheritedListeners[1].Listener
+	// A socket passed for the same address is used even if it is not the first one.
+	if l, err := listen(":8000"); err != nil || l.Listener != named || l.name != ":8000" {
+		t.Fatalf("expected the socket named :8000, got %v (error: %v)", l, err)
+	}
+	// Others are assigned in order.
+	if l, err := listen(":8001"); err != nil || l.Listener != unnamed || l.name != ":8001" {
+		t.Fatalf("expected the unnamed socket, got %v (error: %v)", l, err)
+	}
+	l, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Listener == named || l.Listener == unnamed {
+		t.Fatal("reused a socket that was already taken")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -48,6 +51,13 @@ func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	bind := flag.String("bind", ":8000", "The network ([ip]:port) to bind on.")
 	addr := flag.String("addr", "", "The public address (host[:port]) of this node.")
+	admin := flag.String("admin", "", "The network ([ip]:port) to accept maintenance requests on. Should not be public.")
+	forwardTags := flag.Bool("forward-tags", false, "Pass Matroska tags (e.g. track titles) from broadcasters through to viewers.")
+	proxyViewers := flag.Bool("proxy-viewers", false, "Relay streams from other nodes instead of redirecting viewers to them.")
+	maxIngests := flag.Int("max-ingests", 0, "Send new broadcasters elsewhere when this node already has that many streams.")
+	maxEgress := flag.Int64("max-egress", 0, "Send new broadcasters elsewhere when sending more than this many Mbit/s to viewers.")
+	upgradeTimeout := flag.Duration("upgrade-timeout", time.Hour, "How long to keep serving existing connections after handing off to a new binary on SIGUSR2.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for streams and recordings to be finalized on SIGTERM.")
 	ephemeral := flag.Bool("ephemeral", false, "Use a process-local in-memory userless database. Can only be enabled in joint mode.")
 	flag.Parse()
 
@@ -56,9 +66,14 @@ func main() {
 	}
 
 	ctx := Context{
-		Database:        NewAnonDatabase(),
-		SecureKey:       []byte("12345678901234567890123456789012"),
-		StreamKeepAlive: 20 * time.Second,
+		Database:         NewAnonDatabase(),
+		SecureKey:        []byte("12345678901234567890123456789012"),
+		StreamKeepAlive:  20 * time.Second,
+		StreamSlateDelay: 3 * time.Second,
+		ForwardTags:      *forwardTags,
+		ProxyViewers:     *proxyViewers,
+		MaxIngests:       *maxIngests,
+		MaxEgress:        *maxEgress * 1000000 / 8,
 	}
 	if !*ephemeral {
 		var err error
@@ -67,9 +82,85 @@ func main() {
 		}
 	}
 
+	streams := NewRetransmissionHandler(&ctx)
+	listener, err := listen(*bind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listeners := []*namedListener{listener}
+
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.FileServer(disallowDirectoryListing(".")))
-	mux.Handle("/stream/", UnsafeHandler{NewRetransmissionHandler(&ctx)})
+	mux.Handle("/stream/", UnsafeHandler{streams})
 	mux.Handle("/", UnsafeHandler{NewUIHandler(&ctx)})
-	log.Fatal(http.ListenAndServe(*bind, mux))
+	server := &http.Server{Handler: mux}
+	serve(server, listener)
+
+	adminServer := &http.Server{Handler: UnsafeHandler{AdminHandler{streams}}}
+	if *admin != "" {
+		listener, err := listen(*admin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+		serve(adminServer, listener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(upgradeSignals, syscall.SIGTERM, os.Interrupt)...)
+	upgrading := false
+	for sig := range signals {
+		if sig == syscall.SIGTERM || sig == os.Interrupt {
+			break
+		}
+		if err := upgrade(listeners); err != nil {
+			log.Println("Could not start the new process: ", err)
+			continue
+		}
+		upgrading = true
+		break
+	}
+
+	if upgrading {
+		// The new process is already accepting connections on the same sockets, so
+		// existing ones may take their time. Any stream still here after the timeout
+		// can be resumed there, as it has the same address.
+		log.Println("Upgrading; waiting for existing connections to close...")
+		deadline, cancel := context.WithTimeout(context.Background(), *upgradeTimeout)
+		defer cancel()
+		adminServer.Close()
+		if err := server.Shutdown(deadline); err != nil {
+			log.Println("Some connections did not close in time: ", err)
+			server.Close()
+		}
+		if !streams.Shutdown(*shutdownTimeout) {
+			log.Println("Some streams did not close in time.")
+		}
+		// The new process has a lease of its own, so this one can be released.
+		if err := ctx.Database.Close(); err != nil {
+			log.Println("Error closing the database: ", err)
+		}
+		return
+	}
+
+	log.Println("Shutting down...")
+	deadline, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	adminServer.Close()
+	// Stop accepting connections first, then end the streams to let
+	// the remaining ones finish.
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown(deadline)
+	}()
+	if !streams.Shutdown(*shutdownTimeout) {
+		log.Println("Some streams did not close in time.")
+	}
+	if err := <-stopped; err != nil {
+		log.Println("Some connections did not close in time: ", err)
+		server.Close()
+	}
+	if err := ctx.Database.Close(); err != nil {
+		log.Println("Error closing the database: ", err)
+	}
 }
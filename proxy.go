@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/net/websocket"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to keep receiving a relayed stream after the last local viewer has left.
+	relayIdleTimeout = 10 * time.Second
+	// How long to wait for the owner to respond. Other viewers of the same stream
+	// on this node wait for the same connection; viewers of other streams do not.
+	relayConnectTimeout = 5 * time.Second
+	relayHeaderTimeout  = 10 * time.Second
+)
+
+// The response body is the stream itself, so there can be no overall timeout.
+var relayClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: relayConnectTimeout}).DialContext,
+		ResponseHeaderTimeout: relayHeaderTimeout,
+	},
+}
+
+// A mutex for each key, so that connecting to the owner of one stream does not
+// hold up viewers of the others. Unused entries are removed.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	waiting int
+}
+
+// Lock the mutex for `key`, returning a function that unlocks it.
+func (m *keyedMutex) Lock(key string) func() {
+	m.mutex.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedMutexEntry)
+	}
+	e, ok := m.locks[key]
+	if !ok {
+		e = &keyedMutexEntry{}
+		m.locks[key] = e
+	}
+	e.waiting++
+	m.mutex.Unlock()
+	e.Lock()
+	return func() {
+		e.Unlock()
+		m.mutex.Lock()
+		if e.waiting--; e.waiting == 0 {
+			delete(m.locks, key)
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// Serve a stream that is broadcast to another node as if it were local.
+func (ctx *RetransmissionHandler) proxy(w http.ResponseWriter, r *http.Request, id string, server string) error {
+	if wantsWebsocket(r) {
+		return ctx.relayRPC(w, r, id, server)
+	}
+	stream, err := ctx.relay(id, server)
+	if err == ErrStreamOffline {
+		return RenderError(w, http.StatusNotFound, "Stream offline.")
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.pipe(w, r, id, stream)
+}
+
+// Receive a stream from the node that owns it. All local viewers share a single
+// upstream connection, which is closed once they have all left.
+func (ctx *RetransmissionHandler) relay(id string, server string) (*Broadcast, error) {
+	defer ctx.relayLock.Lock(id)()
+	if cast, ok := ctx.relays.Readable(id); ok {
+		return cast, nil
+	}
+
+	req, err := http.NewRequest("GET", "http://"+server+"/stream/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := ctx.RelayToken(id)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(relayHeader, token)
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, ErrStreamOffline
+	}
+
+	cast, ok := ctx.relays.Writable(id)
+	if !ok {
+		// This node is shutting down.
+		resp.Body.Close()
+		return nil, ErrStreamOffline
+	}
+	go func() {
+		defer resp.Body.Close()
+		defer cast.Close()
+		defer func() {
+			if err := ctx.SetRelayViewers(id, 0); err != nil {
+				log.Println("Error reporting relay viewers: ", err)
+			}
+		}()
+		buffer := [16384]byte{}
+		watched := time.Now()
+		for {
+			n, err := resp.Body.Read(buffer[:])
+			if n != 0 {
+				if _, err := cast.Write(buffer[:n]); err != nil {
+					log.Println("Error relaying a stream: ", err)
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+			if cast.Viewers() != 0 {
+				watched = time.Now()
+			} else if time.Since(watched) > relayIdleTimeout {
+				return
+			}
+		}
+	}()
+	return cast, nil
+}
+
+// Join a websocket to the chat of a relayed stream. All chats for the same stream
+// on this node share a single connection to the node that owns it.
+func (ctx *RetransmissionHandler) relayRPC(w http.ResponseWriter, r *http.Request, id string, server string) error {
+	auth, bot, err := ctx.GetChatAuthInfo(r)
+	if err == ErrInvalidToken {
+		return RenderError(w, http.StatusUnauthorized, "Invalid API token.")
+	}
+	if err != nil && err != ErrUserNotExist {
+		return err
+	}
+	chat, err := ctx.relayChat(id, server)
+	if err != nil {
+		return err
+	}
+	anon := ctx.GetAnonID(r)
+	websocket.Handler(func(ws *websocket.Conn) {
+		for !chat.RunRPC(ws, auth, bot, anon, nil) {
+			if chat, err = ctx.relayChat(id, server); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+	return nil
+}
+
+func (ctx *RetransmissionHandler) relayChat(id string, server string) (*Chat, error) {
+	// Only one connection to the owner per stream, but without holding up everything
+	// else that needs `chatLock` while the owner takes its time to respond.
+	defer ctx.relayChatLock.Lock(id)()
+	ctx.chatLock.Lock()
+	chat, ok := ctx.chats[id]
+	ctx.chatLock.Unlock()
+	if ok {
+		return chat, nil
+	}
+	token, err := ctx.RelayToken(id)
+	if err != nil {
+		return nil, err
+	}
+	config, err := websocket.NewConfig("ws://"+server+"/stream/"+id, "http://"+server)
+	if err != nil {
+		return nil, err
+	}
+	config.Header.Set(relayHeader, token)
+	config.Dialer = &net.Dialer{Timeout: relayConnectTimeout}
+	dialContext, cancel := context.WithTimeout(context.Background(), relayHeaderTimeout)
+	defer cancel()
+	upstream, err := config.DialContext(dialContext)
+	if err != nil {
+		return nil, err
+	}
+	chat = NewRelayChat(20, upstream)
+	chat.db = ctx.Database
+	chat.stream = id
+	if slow, err := ctx.GetChatSlowMode(id); err == nil {
+		chat.slow = int32(slow)
+	}
+	chat.loadFilters()
+	ctx.chatLock.Lock()
+	if existing, ok := ctx.chats[id]; ok {
+		// The stream has come to this node in the meantime.
+		ctx.chatLock.Unlock()
+		chat.Close() // (along with `upstream`)
+		return existing, nil
+	}
+	ctx.chats[id] = chat
+	ctx.chatLock.Unlock()
+	go func() {
+		moved := chat.receive()
+		ctx.chatLock.Lock()
+		defer ctx.chatLock.Unlock()
+		// If it's not there, it has already been closed by `tidyRooms`.
+		if ctx.chats[id] == chat {
+			delete(ctx.chats, id)
+			if moved {
+				// Reconnecting will create a relay of the new room.
+				chat.Move("")
+			}
+			chat.Close()
+		}
+	}()
+	return chat, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	requests := int32(0)
+	done := make(chan struct{})
+	ctx := &RetransmissionHandler{Context: &Context{
+		Database:  testSQLDatabase(t, "b:8000", t.TempDir()+"/relay.db"),
+		SecureKey: []byte("0123456789abcdef0123456789abcdef"),
+	}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream/alice" {
+			http.NotFound(w, r)
+			return
+		}
+		// Relays identify themselves so that they are not counted as viewers.
+		if !ctx.IsRelay(r, "alice") {
+			http.Error(w, "not a relay", http.StatusForbidden)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		w.Write(testWebMHeader())
+		w.Write(testWebMCluster(0))
+		w.Write(testWebMBlock(0, true))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer upstream.Close()
+	defer close(done)
+	server := strings.TrimPrefix(upstream.URL, "http://")
+
+	if _, err := ctx.relay("bob", server); err != ErrStreamOffline {
+		t.Fatalf("expected an offline stream, got %v", err)
+	}
+	cast, err := ctx.relay("alice", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false)
+	defer cast.Disconnect(ch)
+	// Other viewers share the same connection.
+	if again, err := ctx.relay("alice", server); err != nil || again != cast {
+		t.Fatalf("expected the same relay, got %p (error: %v)", again, err)
+	}
+	for deadline := time.Now().Add(time.Second); len(ch) < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if tcs := testBlockTimecodes(t, ch); len(tcs) != 1 || tcs[0] != 0 {
+		t.Fatalf("expected a block at 0, got %v", tcs)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", n)
+	}
+}
+
+func TestRelayToken(t *testing.T) {
+	ctx := &Context{SecureKey: []byte("0123456789abcdef0123456789abcdef")}
+	token, err := ctx.RelayToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/stream/alice", nil)
+	if ctx.IsRelay(r, "alice") {
+		t.Fatal("a request without a token is a relay")
+	}
+	r.Header.Set(relayHeader, token)
+	if !ctx.IsRelay(r, "alice") {
+		t.Fatal("a request with a valid token is not a relay")
+	}
+	if ctx.IsRelay(r, "bob") {
+		t.Fatal("a token for one stream is accepted for another")
+	}
+	other := &Context{SecureKey: []byte("fedcba9876543210fedcba9876543210")}
+	if other.IsRelay(r, "alice") {
+		t.Fatal("a token from a node with a different key is accepted")
+	}
+}
+
+func TestRelayChatSlowOwner(t *testing.T) {
+	ctx := &RetransmissionHandler{chats: make(map[string]*Chat), Context: &Context{
+		Database:  testSQLDatabase(t, "b:8000", t.TempDir()+"/relay.db"),
+		SecureKey: []byte("0123456789abcdef0123456789abcdef"),
+	}}
+	// The owner accepts the connection, but never completes the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed := make(chan error, 1)
+	go func() {
+		_, err := ctx.relayChat("alice", l.Addr().String())
+		dialed <- err
+	}()
+	conn := <-accepted
+	// Meanwhile, rooms of other streams can still be opened.
+	opened := make(chan *Chat, 1)
+	go func() { opened <- ctx.chat("bob", nil) }()
+	select {
+	case chat := <-opened:
+		chat.Close()
+	case <-time.After(time.Second):
+		t.Fatal("waiting for the owner of one stream blocked the chat of another")
+	}
+	conn.Close()
+	if err := <-dialed; err == nil {
+		t.Fatal("joined a chat that never responded")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// https://www.matroska.org/technical/specs/index.html#SeekHead
+	ebmlTagSeek         = 0x4DBB
+	ebmlTagSeekID       = 0x53AB
+	ebmlTagSeekPosition = 0x53AC
+	// https://www.matroska.org/technical/specs/chapters/index.html
+	ebmlTagEditionEntry     = 0x45B9
+	ebmlTagChapterAtom      = 0xB6
+	ebmlTagChapterUID       = 0x73C4
+	ebmlTagChapterTimeStart = 0x91
+	ebmlTagChapterDisplay   = 0x80
+	ebmlTagChapString       = 0x85
+	ebmlTagChapLanguage     = 0x437C
+)
+
+// Where recordings are stored; `StreamHistoryEntry.Path` is relative to this.
+const recordingRoot = "static/recorded"
+
+// Bytes reserved at the start of the Segment for a SeekHead pointing at the Chapters.
+// One entry takes at most 25; the rest is filled with a Void.
+const recordingSeekHeadSpace = 64
+
+// A recording being written to a file. The Segment has an unknown size, so players
+// can only find the Chapters written at the end through a SeekHead at the start;
+// space for it is reserved as a Void, which `finish` then overwrites.
+type recordingWriter struct {
+	f    *os.File
+	size int64
+	// Offsets of the Segment's contents and of the reserved space (0 until the Segment starts).
+	segment  int64
+	seekHead int64
+}
+
+func (w *recordingWriter) Write(chunk []byte) (int, error) {
+	tag := ebmlParseTagIncomplete(chunk)
+	if w.seekHead != 0 || tag.ID != ebmlTagSegment {
+		return w.write(chunk)
+	}
+	if _, err := w.write(chunk[:tag.Consumed]); err != nil {
+		return 0, err
+	}
+	w.segment = w.size
+	if _, err := w.write(ebmlAppendTag(nil, ebmlTagVoid, make([]byte, recordingSeekHeadSpace-2))); err != nil {
+		return tag.Consumed, err
+	}
+	w.seekHead = w.segment
+	n, err := w.write(chunk[tag.Consumed:])
+	return tag.Consumed + n, err
+}
+
+func (w *recordingWriter) write(buf []byte) (int, error) {
+	n, err := w.f.Write(buf)
+	w.size += int64(n)
+	return n, err
+}
+
+// Append the Chapters, if any, and point the SeekHead at them.
+func (w *recordingWriter) finish(chapters []byte) error {
+	if len(chapters) == 0 {
+		return nil
+	}
+	position := w.size - w.segment
+	if _, err := w.write(chapters); err != nil || w.seekHead == 0 {
+		return err
+	}
+	seek := ebmlAppendTag(nil, ebmlTagSeekID, chapters[:4])
+	seek = ebmlAppendUint(seek, ebmlTagSeekPosition, uint64(position))
+	head := ebmlAppendTag(nil, ebmlTagSeekHead, ebmlAppendTag(nil, ebmlTagSeek, seek))
+	head = ebmlAppendTag(head, ebmlTagVoid, make([]byte, recordingSeekHeadSpace-len(head)-2))
+	_, err := w.f.WriteAt(head, w.seekHead)
+	return err
+}
+
+func ebmlChapters(markers []StreamMarker) []byte {
+	edition := []byte{}
+	for i, m := range markers {
+		display := ebmlAppendTag(nil, ebmlTagChapString, []byte(m.Label))
+		display = ebmlAppendTag(display, ebmlTagChapLanguage, []byte("und"))
+		atom := ebmlAppendUint(nil, ebmlTagChapterUID, uint64(i+1))
+		atom = ebmlAppendUint(atom, ebmlTagChapterTimeStart, m.Timecode*1000000 /* ns */)
+		atom = ebmlAppendTag(atom, ebmlTagChapterDisplay, display)
+		edition = ebmlAppendTag(edition, ebmlTagChapterAtom, atom)
+	}
+	return ebmlAppendTag(nil, ebmlTagChapters, ebmlAppendTag(nil, ebmlTagEditionEntry, edition))
+}
+
+// Save a broadcast to a file until it ends or the owner runs out of space.
+// Markers added in the meantime are written as Chapters at the end.
+func (ctx *RetransmissionHandler) record(id string, cast *Broadcast) {
+	defer ctx.recorders.Done()
+	path := fmt.Sprintf("%d.webm", cast.Session)
+	recid, limit, err := ctx.StartRecording(id, cast.Session, path)
+	if err != nil {
+		log.Println("Error starting a recording: ", err)
+	}
+	if err != nil || limit <= 0 {
+		return
+	}
+
+	size := int64(0)
+	defer func() {
+		if err := ctx.StopRecording(id, recid, size); err != nil {
+			log.Println("Error stopping a recording: ", err)
+		}
+	}()
+
+	if err = os.MkdirAll(recordingRoot, 0755); err != nil {
+		log.Println("Error creating a recording: ", err)
+		return
+	}
+	f, err := os.Create(filepath.Join(recordingRoot, path))
+	if err != nil {
+		log.Println("Error creating a recording: ", err)
+		return
+	}
+	defer f.Close()
+
+	// Viewers skip frames when they fall behind, but a recording with gaps is broken,
+	// so the broadcaster waits for the disk instead.
+	ch := make(chan []byte, 1024)
+	stop := make(chan struct{})
+	cast.ConnectBlocking(ch, stop)
+	w := &recordingWriter{f: f}
+	for chunk := range ch {
+		if len(chunk) == 0 || w.size+int64(len(chunk)) > limit {
+			break
+		}
+		if _, err := w.Write(chunk); err != nil {
+			log.Println("Error writing a recording: ", err)
+			break
+		}
+		if cast.Closed {
+			break
+		}
+	}
+	close(stop)
+	cast.Disconnect(ch)
+
+	if markers, err := ctx.GetStreamMarkers(cast.Session); err != nil {
+		log.Println("Error loading markers: ", err)
+	} else if len(markers) != 0 {
+		if err := w.finish(ebmlChapters(markers)); err != nil {
+			log.Println("Error writing chapters: ", err)
+		}
+	}
+	size = w.size
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRecordingMarkers(t *testing.T) {
+	db, err := NewSQLDatabase("", "sqlite3", t.TempDir()+"/recordings.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.NewUser("alice", "alice@example.com", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	session, err := db.StartSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []StreamMarker{{90000, "second"}, {1500, "first"}} {
+		if err := db.AddStreamMarker(session, m.Timecode, m.Label); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, limit, err := db.StartRecording("alice", session, "1.webm"); err != nil || limit != 0 {
+		t.Fatalf("started a recording without any space (limit: %d): %v", limit, err)
+	}
+	if _, err := db.(*sqlDAO).Exec("update users set space_total = 4096 where login = 'alice'"); err != nil {
+		t.Fatal(err)
+	}
+	recid, limit, err := db.StartRecording("alice", session, "1.webm")
+	if err != nil || limit != 4096 {
+		t.Fatalf("could not start a recording (space left: %d): %v", limit, err)
+	}
+	if err := db.StopRecording("alice", recid, 1024); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := db.GetRecording("alice", recid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Path != "1.webm" || rec.Space != 1024 {
+		t.Errorf("unexpected recording: %+v", rec)
+	}
+	if len(rec.Markers) != 2 || rec.Markers[0].Label != "first" || rec.Markers[1].Clock() != "0:01:30" {
+		t.Errorf("expected the markers in order, got %+v", rec.Markers)
+	}
+}
+
+func TestRecordingChapters(t *testing.T) {
+	buf := ebmlChapters([]StreamMarker{{1500, "first"}, {90000, "second"}})
+	chapters := ebmlParseTag(buf)
+	if chapters.ID != ebmlTagChapters || int(chapters.Consumed)+int(chapters.Length) != len(buf) {
+		t.Fatalf("not a Chapters element: %x", buf)
+	}
+	edition := ebmlParseTag(chapters.Contents(buf))
+	var starts []uint64
+	for atoms := edition.Contents(chapters.Contents(buf)); len(atoms) != 0; {
+		atom := ebmlParseTag(atoms)
+		for fields := atom.Contents(atoms); len(fields) != 0; {
+			field := ebmlParseTag(fields)
+			if field.ID == ebmlTagChapterTimeStart {
+				starts = append(starts, fixedUint(field.Contents(fields)))
+			}
+			fields = field.Skip(fields)
+		}
+		atoms = atom.Skip(atoms)
+	}
+	if len(starts) != 2 || starts[0] != 1500000000 || starts[1] != 90000000000 {
+		t.Fatalf("expected chapters at 1.5s and 90s, got %v ns", starts)
+	}
+}
+
+func TestRecordingSeekHead(t *testing.T) {
+	f, err := os.Create(t.TempDir() + "/1.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &recordingWriter{f: f}
+	// Viewers receive the EBML header and the start of the Segment separately.
+	header := testWebMHeader()
+	ebml := ebmlParseTag(header)
+	for _, chunk := range [][]byte{header[:ebml.Consumed+int(ebml.Length)], header[ebml.Consumed+int(ebml.Length):], testWebMCluster(0), testWebMBlock(0, true)} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.finish(ebmlChapters([]StreamMarker{{1500, "first"}})); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := ebml.Skip(buf)
+	contents := segment[ebmlParseTagIncomplete(segment).Consumed:]
+	head := ebmlParseTag(contents)
+	if head.ID != ebmlTagSeekHead {
+		t.Fatalf("expected a SeekHead at the start of the Segment, got %x", head.ID)
+	}
+	if void := ebmlParseTag(head.Skip(contents)); void.ID != ebmlTagVoid || len(contents)-len(void.Skip(head.Skip(contents))) != recordingSeekHeadSpace {
+		t.Fatalf("expected the rest of the reserved space to be a Void, got %x", void.ID)
+	}
+	seek := ebmlParseTag(head.Contents(contents))
+	position := uint64(0)
+	for fields := seek.Contents(head.Contents(contents)); len(fields) != 0; {
+		field := ebmlParseTag(fields)
+		if field.ID == ebmlTagSeekPosition {
+			position = fixedUint(field.Contents(fields))
+		}
+		fields = field.Skip(fields)
+	}
+	if position >= uint64(len(contents)) || ebmlParseTag(contents[position:]).ID != ebmlTagChapters {
+		t.Fatalf("expected the SeekHead to point at the Chapters, got %d", position)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// A short clip shown to viewers while the broadcaster is reconnecting. It is spliced
+// into the stream as-is, so it must use the same tracks and codecs as the stream itself.
+type Slate struct {
+	codecs   [32]string
+	frames   []slateFrame
+	duration time.Duration
+}
+
+type slateFrame struct {
+	frame
+	cluster  uint64 // Timecodes relative to the first cluster in the file.
+	timecode uint64
+}
+
+func ParseSlate(data []byte) (*Slate, error) {
+	s := Slate{}
+	first, cluster := uint64(0), uint64(0)
+	seenCluster := false
+
+	for len(data) != 0 {
+		tag := ebmlParseTagIncomplete(data)
+		if tag.Consumed == 0 {
+			return nil, errors.New("malformed EBML")
+		}
+
+		switch tag.ID {
+		case ebmlTagSegment, ebmlTagCluster, ebmlTagTracks:
+			// Parse the contents of these tags in the same loop.
+			data = data[tag.Consumed:]
+			continue
+		}
+
+		if tag.Length == ebmlIndeterminate || tag.Length+uint64(tag.Consumed) > uint64(len(data)) {
+			return nil, errors.New("truncated EBML")
+		}
+		buf := data[:tag.Length+uint64(tag.Consumed)]
+
+		switch tag.ID {
+		case ebmlTagInfo:
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+				if tag2.ID == 0 {
+					return nil, errors.New("malformed EBML")
+				}
+				if tag2.ID == ebmlTagTimecodeScale && fixedUint(tag2.Contents(buf2)) != 1000000 {
+					return nil, errors.New("invalid timecode scale")
+				}
+				buf2 = tag2.Skip(buf2)
+			}
+
+		case ebmlTagTrackEntry:
+			track, codec := uint64(0), ""
+
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+
+				switch tag2.ID {
+				case 0:
+					return nil, errors.New("malformed EBML")
+
+				case ebmlTagTrackNumber:
+					if track = fixedUint(tag2.Contents(buf2)); track >= 32 {
+						return nil, errors.New("too many tracks")
+					}
+
+				case ebmlTagCodecID:
+					codec = string(tag2.Contents(buf2))
+				}
+
+				buf2 = tag2.Skip(buf2)
+			}
+
+			s.codecs[track] = codec
+
+		case ebmlTagTimecode:
+			if cluster = fixedUint(tag.Contents(buf)); !seenCluster {
+				first, seenCluster = cluster, true
+			}
+			if cluster < first {
+				return nil, errors.New("non-monotonic cluster timecodes")
+			}
+			cluster -= first
+
+		case ebmlTagBlockGroup, ebmlTagSimpleBlock:
+			track, timecode, key, err := ebmlParseBlock(tag, buf)
+			if err != nil {
+				return nil, err
+			}
+			if s.codecs[track] == "" {
+				return nil, errors.New("block belongs to an unknown track")
+			}
+			s.frames = append(s.frames, slateFrame{frame{buf, track, key}, cluster, cluster + timecode})
+		}
+
+		data = tag.Skip(data)
+	}
+
+	if len(s.frames) == 0 {
+		return nil, errors.New("the slate contains no frames")
+	}
+	// Assume the last frame lasts as long as an average one does.
+	last := s.frames[len(s.frames)-1].timecode
+	s.duration = time.Duration(last+last/uint64(len(s.frames))+1) * time.Millisecond
+	return &s, nil
+}
+
+// Whether the slate can be spliced into a stream with these tracks.
+func (s *Slate) Compatible(codecs *[32]string) bool {
+	for track, codec := range s.codecs {
+		if codec != "" && codec != codecs[track] {
+			return false
+		}
+	}
+	return true
+}
@@ -106,24 +106,36 @@ $.form.onDocumentReload = doc => {
 };
 
 
-let withRPC = rpc => ({
+let withRPC = rpc => Object.assign(withChat(rpc, true), {
     '.viewers'(e) {
         rpc.on('Stream.ViewerCount', n => e.textContent = n);
     },
 
+    '.now-playing'(e) {
+        rpc.on('Stream.Metadata', tags =>
+            e.textContent = tags.ARTIST && tags.TITLE ? `${tags.ARTIST} — ${tags.TITLE}` : tags.TITLE || '');
+    },
+
     '.player'(e) {
+        let stop = _ => {
+            if (e.dataset.live) delete e.dataset.live;
+            e.dataset.src = '';
+        };
         rpc.on(RPC.STATE_INIT, _ => e.dataset.status = 'loading');
-        rpc.on(RPC.STATE_OPEN, _ => {
+        rpc.on('Stream.Online', _ => {
             // TODO measure connection speed, request a stream
             e.dataset.src = rpc.url.replace('ws', 'http');
             e.dataset.live = '1';
         });
-        rpc.on(RPC.STATE_CLOSED, _ => {
-            if (e.dataset.live) delete e.dataset.live;
-            e.dataset.src = '';
-        });
+        rpc.on('Stream.Offline', stop);
+        rpc.on(RPC.STATE_CLOSED, stop);
     },
+});
+
 
+// Recordings only have a (read-only) chat, so this is also used by the replay.
+// Only the live chat has a history to scroll back through, though.
+let withChat = (rpc, scrollBack) => ({
     '.chat'(e) {
         let log = e.querySelector('.log');
         let autoscroll = f => (...args) => {
@@ -166,7 +178,8 @@ let withRPC = rpc => ({
 
         rpc.on(RPC.STATE_OPEN,   autoscroll(_ => e.classList.add('online')));
         rpc.on(RPC.STATE_CLOSED, autoscroll(_ => e.classList.remove('online')));
-        rpc.on('Chat.Message', autoscroll((name, text, login) => {
+
+        let render = (name, text, login, id, time, anon, bot) => {
             let h = parseInt(sha1(`${login}\n${name}`).slice(32), 16);
             let m = document.createElement('li');
             let nameSpan = document.createElement('span');
@@ -175,12 +188,122 @@ let withRPC = rpc => ({
             nameSpan.style.color = `hsl(${h % 359},${(h / 359|0) % 80 + 10}%,${((h / 359|0) / 60|0) % 30 + 20}%)`;
             nameSpan.textContent = name;
             nameSpan.setAttribute('title', login);
+            if (bot)
+                nameSpan.classList.add('bot');
             textSpan.textContent = text;
             textSpan.innerHTML = textSpan.innerHTML.replace($.emoji.re, $.emoji.wrap);
             m.appendChild(nameSpan);
             m.appendChild(textSpan);
+            m.dataset.id = id || 0;
+            if (time)
+                m.setAttribute('title', new Date(time).toLocaleString());
+            return m;
+        };
+
+        // History entries are lists of a notification name and its parameters.
+        let renderAs = (method, ...args) => {
+            let m = render(...args);
+            if (method === 'Chat.Action')
+                m.classList.add('action');
+            return m;
+        };
+
+        let notice = text => {
+            let m = document.createElement('li');
+            m.classList.add('notice');
+            m.textContent = text;
+            return m;
+        };
+
+        rpc.on('Chat.Message', autoscroll((...args) => log.appendChild(render(...args))));
+        rpc.on('Chat.Action',  autoscroll((...args) => log.appendChild(renderAs('Chat.Action', ...args))));
+        rpc.on('Chat.Notice',  autoscroll(text => log.appendChild(notice(text))));
+        rpc.on('Chat.Whisper', autoscroll((from, to, text, login) => {
+            let m = render(from, text, login);
+            m.classList.add('whisper');
+            m.querySelector('.name').textContent = `${from} → ${to}`;
+            log.appendChild(m);
+        }));
+        rpc.on('Chat.Clear', name => {
+            log.innerHTML = '';
+            log.appendChild(notice(`${name} has cleared the chat.`));
+        });
+        rpc.on('Chat.Banned', autoscroll(seconds => log.appendChild(notice(seconds
+            ? `You have been timed out for ${seconds} seconds.`
+            : 'You have been banned from this chat.'))));
+        rpc.on('Chat.UserBanned', autoscroll((login, anon, seconds, by) => log.appendChild(notice(seconds
+            ? `${by} has timed out ${login || 'an anonymous user'} for ${seconds} seconds.`
+            : `${by} has banned ${login || 'an anonymous user'}.`))));
+        rpc.on('Chat.MessageDeleted', id => {
+            for (let m of log.querySelectorAll(`[data-id="${id}"]`))
+                m.remove();
+        });
+
+        rpc.on('Chat.MessageHeld', autoscroll((id, name, text, login, action, anon, reason) => {
+            let m = render(name, text, login);
+            m.classList.add('held');
+            m.dataset.held = id;
+            m.setAttribute('title', `Held: ${reason}`);
+            for (let [label, method] of [['Approve', 'Chat.ApproveMessage'], ['Reject', 'Chat.RejectMessage']]) {
+                let b = document.createElement('a');
+                b.href = '#';
+                b.textContent = label;
+                b.addEventListener('click', ev => {
+                    ev.preventDefault();
+                    rpc.send(method, id).catch(_ => m.remove());
+                });
+                m.appendChild(b);
+            }
             log.appendChild(m);
         }));
+        rpc.on('Chat.HeldResolved', id => {
+            for (let m of log.querySelectorAll(`[data-held="${id}"]`))
+                m.remove();
+        });
+
+        let poll = document.createElement('div');
+        poll.classList.add('poll');
+        rpc.on('Chat.PollUpdate', (id, question, options, votes, ends, open) => {
+            let total = votes.reduce((a, b) => a + b, 0);
+            let q = document.createElement('p');
+            q.textContent = open ? question : `${question} (closed)`;
+            poll.innerHTML = '';
+            poll.appendChild(q);
+            options.forEach((text, i) => {
+                let b = document.createElement('a');
+                b.href = '#';
+                b.classList.add('option');
+                b.textContent = `${text}: ${votes[i]}`;
+                b.style.backgroundSize = `${total ? votes[i] * 100 / total : 0}% 100%`;
+                b.addEventListener('click', ev => {
+                    ev.preventDefault();
+                    if (open)
+                        rpc.send('Chat.Vote', id, i).catch(err => q.textContent = `${question} (${err.message})`);
+                });
+                poll.appendChild(b);
+            });
+            poll.classList.toggle('closed', !open);
+            log.parentElement.insertBefore(poll, log);
+        });
+
+        if (scrollBack) {
+            let loading = false;
+            log.addEventListener('scroll', _ => {
+                let first = log.querySelector('[data-id]:not([data-id="0"])');
+                if (loading || log.scrollTop > 0 || !first || !+first.dataset.id)
+                    return;
+                loading = true;
+                rpc.send('Chat.RequestHistory', +first.dataset.id, 50).then(msgs => {
+                    let height = log.scrollHeight;
+                    for (let args of msgs.reverse())
+                        log.insertBefore(renderAs(...args), log.firstChild);
+                    log.scrollTop += log.scrollHeight - height;
+                    // An empty page means there is nothing older.
+                    loading = msgs.length === 0;
+                }).catch(_ => loading = false);
+            });
+        }
+
         rpc.on('Chat.AcquiredName', autoscroll((name, login) => {
             e.classList.add('logged-in');
             e.querySelector('.input-form textarea').select();
@@ -214,7 +337,32 @@ $.extend({
     },
 
     '[data-stream-src]'(e) {
-        confirmMaturity(e).then(() => e.querySelector('.player').dataset.src = e.dataset.streamSrc);
+        let rpc   = new RPC();
+        let video = e.querySelector('.player video');
+        let log   = e.querySelector('.chat .log');
+        // The chat is replayed in sync with the video; after seeking, it has to start over.
+        let seek = _ => {
+            log.innerHTML = '';
+            rpc.send('Replay.Seek', video.currentTime);
+        };
+        rpc.on(RPC.STATE_OPEN, seek);
+        video.addEventListener('seeked', _ => rpc.state === RPC.STATE_OPEN && seek());
+        video.addEventListener('timeupdate', _ =>
+            rpc.state === RPC.STATE_OPEN && !video.seeking && rpc.send('Replay.Sync', video.currentTime));
+        $.apply(e, withChat(rpc));
+        confirmMaturity(e).then(() => {
+            e.querySelector('.player').dataset.src = e.dataset.streamSrc;
+            rpc.open(`${location.protocol.replace('http', 'ws')}//${location.host}${location.pathname}`);
+        });
+    },
+
+    '[data-seek]'(e) {
+        e.addEventListener('click', ev => {
+            let video = document.querySelector('.player video');
+            ev.preventDefault();
+            video.currentTime = +e.dataset.seek;
+            video.play().catch(_ => null);
+        });
     },
 
     '.player-block'(e) {
@@ -285,6 +433,7 @@ $.extend({
         video.addEventListener('waiting',        _ => e.dataset.statusUi = 'loading');
         video.addEventListener('timeupdate',     _ => setTime(video.currentTime));
         video.addEventListener('volumechange',   _ => setVolume(video.volume, video.muted));
+        video.textTracks.addEventListener('addtrack', ev => ev.track.mode = 'showing');
         $.observeData(e, 'src', '', src => (video.src = src) ? ignoreErrors(video.play()) : setError(4));
 
         e.button('.play', _ => {
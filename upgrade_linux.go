@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Signals that make the server start a new instance of itself (e.g. after the binary
+// has been replaced) and hand over the listening sockets to it.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// The first inherited descriptor; see sd_listen_fds(3).
+const listenFdsStart = 3
+
+func inheritListeners() []*namedListener {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	// systemd sets the PID to make sure the variables were meant for this process.
+	// `upgrade` does not know it in advance, so it leaves it out.
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := []*namedListener{}
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		syscall.CloseOnExec(listenFdsStart + i)
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Println("Ignoring an inherited socket: ", err)
+			continue
+		}
+		listeners = append(listeners, &namedListener{l, name})
+	}
+	return listeners
+}
+
+// Start the current binary with the same arguments, passing it the sockets.
+// Both processes will accept connections until this one closes its listeners.
+func upgrade(listeners []*namedListener) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	files := []*os.File{}
+	names := []string{}
+	for _, l := range listeners {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return errors.New("cannot pass a socket of this type")
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") {
+			env = append(env, kv)
+		}
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(env, "LISTEN_FDS="+strconv.Itoa(len(files)), "LISTEN_FDNAMES="+strings.Join(names, ":"))
+	cmd.ExtraFiles = files
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Start()
+}
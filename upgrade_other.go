@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var upgradeSignals = []os.Signal{}
+
+func inheritListeners() []*namedListener {
+	return nil
+}
+
+func upgrade(listeners []*namedListener) error {
+	return errors.New("only supported on Linux")
+}